@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// activationListeners returns no sockets, as there is no systemd.
+func activationListeners() ([]net.Listener, error) {
+	return nil, nil
+}
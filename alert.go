@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/rnurgaliyev/co2meter_exporter/co2meter"
+)
+
+const alertTimeout = time.Second * 10
+
+type alertEvent struct {
+	Event    string  `json:"event"`
+	Device   string  `json:"device"`
+	Location string  `json:"location,omitempty"`
+	Co2      float64 `json:"co2"`
+	Ts       int64   `json:"ts"`
+}
+
+// alertState tracks whether a meter is above the alert threshold and when
+// the last notification went out.
+type alertState struct {
+	alerting bool
+	lastSent time.Time
+}
+
+func postAlert(ctx context.Context, event alertEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, alertTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *alertWebhookFlag, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// alertSink posts a high_co2 event to the webhook when the CO2 reading of a
+// meter rises above the threshold, and a cleared event once it fell below
+// the threshold minus the hysteresis. Changes within the minimum interval
+// after a notification wait until it elapsed, to keep a flapping reading
+// from spamming. Failed notifications are retried with the next reading.
+type alertSink struct {
+	alerts  map[*envState]*alertState
+	pending []pendingAlert
+}
+
+type pendingAlert struct {
+	alert *alertState
+	event alertEvent
+}
+
+func newAlertSink() *alertSink {
+	return &alertSink{alerts: make(map[*envState]*alertState)}
+}
+
+// Publish checks every CO2 reading against the threshold, the events are
+// posted on Flush.
+func (a *alertSink) Publish(event readingEvent) {
+	settings := current()
+	if settings.alertThreshold <= 0 || event.reading.Kind != co2meter.CO2 {
+		return
+	}
+	state, now := event.state, time.Now()
+
+	alert := a.alerts[state]
+	if alert == nil {
+		alert = &alertState{}
+		a.alerts[state] = alert
+	}
+	// Only the latest reading before a flush counts
+	a.pending = slices.DeleteFunc(a.pending, func(p pendingAlert) bool { return p.alert == alert })
+	co2 := state.Co2()
+
+	var kind string
+	switch {
+	case !alert.alerting && co2 > float64(settings.alertThreshold):
+		kind = "high_co2"
+	case alert.alerting && co2 < float64(settings.alertThreshold-settings.alertHysteresis):
+		kind = "cleared"
+	default:
+		return
+	}
+	if now.Sub(alert.lastSent) < settings.alertMinInterval {
+		return
+	}
+
+	a.pending = append(a.pending, pendingAlert{alert, alertEvent{
+		Event:    kind,
+		Device:   state.device,
+		Location: state.location,
+		Co2:      co2,
+		Ts:       now.Unix(),
+	}})
+}
+
+func (a *alertSink) Flush(ctx context.Context) {
+	for _, p := range a.pending {
+		event := p.event
+		if err := postAlert(ctx, event); err != nil {
+			slog.Error("Posting alert failed", "device", event.Device, "event", event.Event, "err", err)
+			continue
+		}
+
+		slog.Info("Posted alert", "device", event.Device, "event", event.Event, "co2", event.Co2)
+		p.alert.alerting = event.Event == "high_co2"
+		p.alert.lastSent = time.Now()
+	}
+
+	a.pending = a.pending[:0]
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rnurgaliyev/co2meter_exporter/co2meter"
+)
+
+const (
+	autoDecryptFrames  = 16
+	autoDecryptTimeout = 30 * time.Second
+)
+
+// decryptionDetector finds out whether a meter encrypts its frames by
+// checking which interpretation of the first frames yields valid checksums
+// and known codes, either the frames as they are or decoded by encrypted.
+type decryptionDetector struct {
+	encrypted co2meter.Decoder
+	deadline  time.Time
+	frames    int
+	decrypted int
+	raw       int
+}
+
+func newDecryptionDetector(encrypted co2meter.Decoder) *decryptionDetector {
+	return &decryptionDetector{encrypted: encrypted, deadline: time.Now().Add(autoDecryptTimeout)}
+}
+
+func plausibleFrame(frame []byte) bool {
+	return co2meter.IsValidFrame(frame) && co2meter.ParseFrame(frame).Kind != co2meter.Unknown
+}
+
+// observe checks another frame. Once enough frames were seen, or the
+// detection timed out, it returns whether decryption is to be skipped, and
+// whether the frames were conclusive at all.
+func (d *decryptionDetector) observe(buffer []byte, key []byte) (skip bool, conclusive bool, done bool) {
+	d.frames++
+	if plausibleFrame(d.encrypted.Decode(buffer, key)) {
+		d.decrypted++
+	}
+	if plausibleFrame(buffer) {
+		d.raw++
+	}
+
+	if d.frames < autoDecryptFrames && time.Now().Before(d.deadline) {
+		return false, false, false
+	}
+	return d.raw > d.decrypted, d.raw != d.decrypted, true
+}
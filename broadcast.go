@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rnurgaliyev/co2meter_exporter/co2meter"
+)
+
+// stateBufferSize is the number of readings buffered for applyReadings.
+const stateBufferSize = 64
+
+// readingEvent is a decoded reading of a meter.
+type readingEvent struct {
+	state   *envState
+	reading co2meter.Reading
+}
+
+// broadcaster fans the readings out to its subscribers. Every subscriber
+// has a bounded buffer, and drops its oldest reading when it cannot keep
+// up, so a slow subscriber never blocks the readers. The dropped readings
+// are counted by the name of the subscriber.
+type broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan readingEvent]prometheus.Counter
+}
+
+// broadcast carries the readings of all meters, and applied those
+// applyReadings updated the state of their meter with.
+var broadcast, applied broadcaster
+
+// subscribe returns a channel receiving the readings published from now on,
+// and a function to unsubscribe, which closes the channel.
+func (b *broadcaster) subscribe(name string, size int) (<-chan readingEvent, func()) {
+	ch := make(chan readingEvent, size)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan readingEvent]prometheus.Counter)
+	}
+	b.subscribers[ch] = droppedReadingsCounter.WithLabelValues(name)
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *broadcaster) publish(event readingEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, dropped := range b.subscribers {
+		select {
+		case ch <- event:
+			continue
+		default:
+		}
+
+		// Make room by dropping the oldest reading, unless the subscriber
+		// just took it. As publishers hold the lock, the send cannot fail
+		// then.
+		select {
+		case <-ch:
+			dropped.Inc()
+		default:
+		}
+		ch <- event
+	}
+}
+
+// plausible reports whether a reading is within the bounds given by
+// -co2-min, -co2-max, -temp-min and -temp-max, before calibration.
+func plausible(reading co2meter.Reading) bool {
+	switch reading.Kind {
+	case co2meter.CO2:
+		return reading.Value >= int32(*co2MinFlag) && reading.Value <= int32(*co2MaxFlag)
+	case co2meter.Temperature:
+		celsius := kelvin16ToCelsius(reading.Value)
+		return celsius >= *tempMinFlag && celsius <= *tempMaxFlag
+	}
+	return true
+}
+
+// applyReadings updates the states of the meters with the calibrated
+// readings until events is closed or ctx is done, and republishes the
+// readings it applied to the subscribers of applied. Readings of unknown
+// codes, implausible ones and outliers are not.
+func applyReadings(ctx context.Context, events <-chan readingEvent) {
+	for {
+		var event readingEvent
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			event = e
+		}
+
+		state, value := event.state, event.reading.Value
+		settings := current()
+		state.checkWarmup(time.Now())
+		if !plausible(event.reading) {
+			slog.Debug("Implausible reading", "device", state.device, "kind", event.reading.Kind, "value", value)
+			implausibleCounter.WithLabelValues(append(state.labelValues(), event.reading.Kind.String())...).Inc()
+			continue
+		}
+		switch event.reading.Kind {
+		case co2meter.CO2:
+			if !state.acceptCo2(value) {
+				continue
+			}
+			state.setCo2(value, int32(math.Round(settings.co2Calibration.apply(float64(value)))))
+			recordHistory(state)
+		case co2meter.Temperature:
+			state.setTemperature(value, settings.temperatureCalibration.apply(kelvin16ToCelsius(value)))
+		case co2meter.Humidity:
+			state.setHumidity(value)
+		default:
+			continue
+		}
+		applied.publish(event)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "math"
+
+// Conditions the meters are calibrated at, and the mass concentration is
+// computed at without a temperature reading
+const (
+	standardTemperature = 25     // degree celsius
+	standardPressure    = 101325 // Pa
+)
+
+// altitudePressure returns the air pressure in Pa at an altitude in meters
+// according to the international standard atmosphere.
+func altitudePressure(altitude float64) float64 {
+	return standardPressure * math.Pow(1-2.25577e-5*altitude, 5.25588)
+}
+
+// pressureCorrection returns the factor CO2 readings are multiplied with at
+// a pressure in Pa. The meters count the molecules in their chamber, so
+// they read low where the air is thinner.
+func pressureCorrection(pressure float64) float64 {
+	return standardPressure / pressure
+}
+
+// co2MassConcentration returns the mass concentration in mg/m³ of a CO2
+// reading in PPM at a temperature in degree celsius and a pressure in Pa.
+func co2MassConcentration(ppm, tempC, pressure float64) float64 {
+	const co2MolarMass = 44.0095 // g/mol
+
+	molarVolume := gasConstant * (tempC + 273.15) / pressure // m³/mol
+	return ppm * co2MolarMass / molarVolume / 1000
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCo2MassConcentration(t *testing.T) {
+	tests := []struct {
+		ppm, tempC, pressure float64
+		want                 float64
+	}{
+		{400, 25, standardPressure, 719.5},
+		{400, 0, standardPressure, 785.4},
+		{1000, 25, standardPressure / 2, 899.4},
+		{0, 25, standardPressure, 0},
+	}
+
+	for _, tt := range tests {
+		got := co2MassConcentration(tt.ppm, tt.tempC, tt.pressure)
+		if math.Abs(got-tt.want) > 0.1 {
+			t.Errorf("co2MassConcentration(%v, %v, %v) = %v, want %v", tt.ppm, tt.tempC, tt.pressure, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Package co2meter reads the USB-zyTemp CO2 meters sold under various brands
+// through the HID interface of the platform.
+package co2meter
+
+// Following code is based on this great work:
+// https://hackaday.io/project/5301-reverse-engineering-a-low-cost-usb-co-monitor/log/17909-all-your-base-are-belong-to-us
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// USB IDs of the meters, which all report as USB-zyTemp
+const (
+	VendorID  = 0x04d9
+	ProductID = 0xa052
+)
+
+// FrameSize is the size of the frames sent by the meter.
+const FrameSize = 8
+
+// KeySize is the size of the key the meter encrypts its frames with.
+const KeySize = 8
+
+// ErrKeySize is returned when opening a meter with a key that is not
+// KeySize bytes long.
+var ErrKeySize = errors.New("key must be 8 bytes")
+
+// ErrInvalidFrame is returned by Read for frames that fail CheckFrame. The
+// errors of CheckFrame wrap it, so errors.Is tells invalid frames apart from
+// failed reads.
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// ErrEndMarker is returned by CheckFrame for frames without the end marker,
+// which usually means the frame was decrypted with the wrong key.
+var ErrEndMarker = fmt.Errorf("%w: no end marker", ErrInvalidFrame)
+
+// ErrChecksum is returned by CheckFrame for frames with the end marker but a
+// bad checksum, which usually means the frame was corrupted on the way.
+var ErrChecksum = fmt.Errorf("%w: bad checksum", ErrInvalidFrame)
+
+// ErrInfoNotSupported is returned by Info on platforms that cannot describe
+// the USB device.
+var ErrInfoNotSupported = errors.New("device info is not supported on this platform")
+
+// Kind tells which quantity a reading carries.
+type Kind int
+
+const (
+	Unknown Kind = iota
+	CO2
+	Temperature
+	Humidity
+)
+
+func (k Kind) String() string {
+	switch k {
+	case CO2:
+		return "co2"
+	case Temperature:
+		return "temperature"
+	case Humidity:
+		return "humidity"
+	}
+	return "unknown"
+}
+
+// Reading is a single value reported by the meter. CO2 is in PPM,
+// temperature in 1/16 kelvin and humidity in 1/100 percent.
+type Reading struct {
+	Code  byte
+	Value int32
+	Kind  Kind
+}
+
+// Info describes the USB device of a meter. Fields are left empty where the
+// platform cannot tell.
+type Info struct {
+	Vendor  uint16
+	Product uint16
+	Serial  string
+	// Name is made up of the manufacturer and product strings, e.g.
+	// "Holtek USB-zyTemp".
+	Name string
+}
+
+// IsMeter reports whether info has the USB IDs of the meters.
+func (i Info) IsMeter() bool {
+	return i.Vendor == VendorID && i.Product == ProductID
+}
+
+// hid is the platform specific HID interface of a meter. Reads return the
+// raw 8 byte frames sent by the meter.
+type hid interface {
+	io.ReadCloser
+
+	// SendKey sends the 8 byte key the meter encrypts its frames with as
+	// HID feature report with the given number.
+	SendKey(reportNumber byte, key []byte) error
+}
+
+// infoDevice is implemented by HID interfaces that can describe the device.
+type infoDevice interface {
+	Info() (Info, error)
+}
+
+// Device is an opened CO2 meter.
+type Device struct {
+	hid     hid
+	key     [KeySize]byte
+	replay  bool
+	decoder Decoder
+}
+
+// Options tell Open how to open a meter. The zero value sends a random key
+// as feature report 0 and decrypts the frames with ZyTempDecoder.
+type Options struct {
+	// ReportNumber is the number of the feature report the key is sent as,
+	// which is zero for all known meters but some clones.
+	ReportNumber byte
+
+	// Key is the key of KeySize bytes sent to the meter instead of a random
+	// one, so the frames can be decrypted again later. For captures it is
+	// the key the frames were encrypted with.
+	Key []byte
+
+	// Loop makes captures start over at their end, instead of reads failing
+	// with io.EOF. Open fails with Loop for anything but a capture file.
+	Loop bool
+
+	// Decoder decodes the frames in Read, ZyTempDecoder if nil. Some meter
+	// models need PlainDecoder.
+	Decoder Decoder
+}
+
+// Open opens the meter at path and sends it the key to encrypt its frames
+// with. Regular files are opened as captures of raw frames, which are then
+// read as if they came from a meter.
+func Open(path string, opts Options) (*Device, error) {
+	if opts.Key != nil && len(opts.Key) != KeySize {
+		return nil, ErrKeySize
+	}
+	if opts.Decoder == nil {
+		opts.Decoder = ZyTempDecoder
+	}
+	if stat, err := os.Stat(path); opts.Loop || err == nil && stat.Mode().IsRegular() {
+		return openReplay(path, opts)
+	}
+
+	source, err := openHID(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Device{hid: source, decoder: opts.Decoder}
+	if opts.Key != nil {
+		copy(d.key[:], opts.Key)
+	} else {
+		rand.Read(d.key[:])
+	}
+
+	if err := source.SendKey(opts.ReportNumber, d.key[:]); err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Key returns the key the meter encrypts its frames with.
+func (d *Device) Key() []byte {
+	return d.key[:]
+}
+
+// IsReplay reports whether the device replays a capture file.
+func (d *Device) IsReplay() bool {
+	return d.replay
+}
+
+// Info describes the USB device of the meter.
+func (d *Device) Info() (Info, error) {
+	if source, ok := d.hid.(infoDevice); ok {
+		return source.Info()
+	}
+	return Info{}, ErrInfoNotSupported
+}
+
+// ReadFrame reads the next raw frame, as it was sent by the meter.
+func (d *Device) ReadFrame() ([]byte, error) {
+	// Every data measurement from device comes in 8 byte chunks
+	frame := make([]byte, FrameSize)
+	if _, err := io.ReadFull(d.hid, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// Read reads and decodes the next frame. Only decrypted frames are checked
+// with CheckFrame, plain ones are taken as they are.
+func (d *Device) Read() (Reading, error) {
+	frame, err := d.ReadFrame()
+	if err != nil {
+		return Reading{}, err
+	}
+
+	if d.decoder != PlainDecoder {
+		frame = d.decoder.Decode(frame, d.key[:])
+		if err := CheckFrame(frame); err != nil {
+			return Reading{}, err
+		}
+	}
+
+	return ParseFrame(frame), nil
+}
+
+// Close closes the meter, which makes pending reads fail.
+func (d *Device) Close() error {
+	return d.hid.Close()
+}
+
+// Decrypt decrypts a frame with the key sent to the meter. It returns nil
+// if the frame is shorter than FrameSize or the key shorter than KeySize.
+func Decrypt(buffer []byte, key []byte) []byte {
+	if len(buffer) < FrameSize || len(key) < KeySize {
+		return nil
+	}
+
+	var cstate = []byte{0x48, 0x74, 0x65, 0x6D, 0x70, 0x39, 0x39, 0x65}
+	var shuffle = []byte{2, 4, 0, 7, 1, 6, 5, 3}
+
+	phase1 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	for i, j := range shuffle {
+		phase1[j] = buffer[i]
+	}
+
+	phase2 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	for i := range shuffle {
+		phase2[i] = phase1[i] ^ key[i]
+	}
+
+	phase3 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	for i := range shuffle {
+		phase3[i] = ((phase2[i] >> 3) | (phase2[(i-1+8)%8] << 5)) & 0xff
+	}
+
+	ctmp := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	for i := range shuffle {
+		ctmp[i] = ((cstate[i] >> 4) | (cstate[i] << 4)) & 0xff
+	}
+
+	out := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	for i := range shuffle {
+		out[i] = (byte)(((0x100 + (int)(phase3[i]) - (int)(ctmp[i])) & (int)(0xff)))
+	}
+
+	return out
+}
+
+// CheckFrame checks the end marker and checksum of a decrypted frame, and
+// returns ErrEndMarker or ErrChecksum if either is wrong. Frames shorter than
+// FrameSize fail with ErrEndMarker.
+func CheckFrame(buffer []byte) error {
+	if len(buffer) < FrameSize || buffer[4] != 0x0D {
+		return ErrEndMarker
+	}
+	if (buffer[0]+buffer[1]+buffer[2])&0xFF != buffer[3] {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+// IsValidFrame reports whether a decrypted frame passes CheckFrame.
+func IsValidFrame(buffer []byte) bool {
+	return CheckFrame(buffer) == nil
+}
+
+// ParseFrame extracts the reading of a decrypted frame.
+func ParseFrame(frame []byte) Reading {
+	reading := Reading{
+		Code:  frame[0],
+		Value: int32(binary.BigEndian.Uint16(frame[1:3])),
+	}
+
+	switch reading.Code {
+	case 0x50:
+		reading.Kind = CO2
+	case 0x42:
+		reading.Kind = Temperature
+	case 0x41:
+		reading.Kind = Humidity
+	}
+
+	return reading
+}
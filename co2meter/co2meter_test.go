@@ -0,0 +1,79 @@
+package co2meter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKey is the key the encrypted frames in testdata were encrypted with.
+// The frames are synthetic: they were made from known readings with this
+// key, not captured from a meter, so they check that decryption stays the
+// same rather than that it matches the hardware.
+var testKey = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+func TestFrames(t *testing.T) {
+	tests := []struct {
+		file string
+		key  []byte // nil for plain frames
+		err  error
+		want Reading
+	}{
+		{"co2.bin", testKey, nil, Reading{Code: 0x50, Value: 923, Kind: CO2}},
+		{"temperature.bin", testKey, nil, Reading{Code: 0x42, Value: 4722, Kind: Temperature}},
+		{"humidity.bin", nil, nil, Reading{Code: 0x41, Value: 4500, Kind: Humidity}},
+		{"corrupted.bin", testKey, ErrChecksum, Reading{}},
+		{"co2.bin", nil, ErrEndMarker, Reading{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			frame := raw
+			if tt.key != nil {
+				frame = Decrypt(raw, tt.key)
+			}
+			if err := CheckFrame(frame); !errors.Is(err, tt.err) {
+				t.Fatalf("CheckFrame(%x) = %v, want %v", frame, err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if got := ParseFrame(frame); got != tt.want {
+				t.Errorf("ParseFrame(%x) = %+v, want %+v", frame, got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzDecryptReading(f *testing.F) {
+	for _, file := range []string{"co2.bin", "temperature.bin", "humidity.bin", "corrupted.bin"} {
+		raw, err := os.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(raw, testKey)
+	}
+	f.Add([]byte{}, []byte{})
+
+	f.Fuzz(func(t *testing.T, raw []byte, key []byte) {
+		frame := Decrypt(raw, key)
+		if len(raw) < FrameSize || len(key) < KeySize {
+			if frame != nil {
+				t.Fatalf("Decrypt(%x, %x) = %x, want nil", raw, key, frame)
+			}
+			return
+		}
+		if len(frame) != FrameSize {
+			t.Fatalf("Decrypt(%x, %x) returned %d bytes", raw, key, len(frame))
+		}
+		if IsValidFrame(frame) {
+			ParseFrame(frame)
+		}
+	})
+}
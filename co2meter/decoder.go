@@ -0,0 +1,53 @@
+package co2meter
+
+import (
+	"maps"
+	"slices"
+)
+
+// Decoder turns the frames sent by a meter into plain frames, as checked by
+// IsValidFrame and parsed by ParseFrame.
+type Decoder interface {
+	// Decode returns the plain frame of one the meter encrypted with key.
+	Decode(frame []byte, key []byte) []byte
+}
+
+// ZyTempDecoder decrypts the frames of the original USB-zyTemp firmware,
+// see Decrypt.
+var ZyTempDecoder Decoder = zyTempDecoder{}
+
+// PlainDecoder takes the frames as they are, for meters that do not
+// encrypt them.
+var PlainDecoder Decoder = plainDecoder{}
+
+type zyTempDecoder struct{}
+
+func (zyTempDecoder) Decode(frame []byte, key []byte) []byte {
+	return Decrypt(frame, key)
+}
+
+type plainDecoder struct{}
+
+func (plainDecoder) Decode(frame []byte, key []byte) []byte {
+	return frame
+}
+
+// decoders maps the model names accepted by LookupDecoder to the decoders.
+// The TFA AirCO2ntrol meters run the zyTemp firmware under another brand.
+var decoders = map[string]Decoder{
+	"co2mini": ZyTempDecoder,
+	"tfa":     ZyTempDecoder,
+	"plain":   PlainDecoder,
+}
+
+// LookupDecoder returns the decoder of the model with the given name, or
+// false if there is none.
+func LookupDecoder(name string) (Decoder, bool) {
+	d, ok := decoders[name]
+	return d, ok
+}
+
+// DecoderNames returns the names accepted by LookupDecoder, sorted.
+func DecoderNames() []string {
+	return slices.Sorted(maps.Keys(decoders))
+}
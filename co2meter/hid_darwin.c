@@ -0,0 +1,140 @@
+#include "_cgo_export.h"
+
+#include <stdlib.h>
+
+static void inputReportCallback(void *context, IOReturn result, void *sender,
+	IOHIDReportType type, uint32_t reportID, uint8_t *report,
+	CFIndex reportLength)
+{
+	if (result == kIOReturnSuccess)
+		co2InputReport((uintptr_t)context, report, reportLength);
+}
+
+static void removalCallback(void *context, IOReturn result, void *sender)
+{
+	co2DeviceRemoved((uintptr_t)context);
+}
+
+IOHIDManagerRef co2CreateManager(int32_t vendor, int32_t product)
+{
+	IOHIDManagerRef manager;
+	CFMutableDictionaryRef match;
+	CFNumberRef vendorRef, productRef;
+
+	manager = IOHIDManagerCreate(kCFAllocatorDefault, kIOHIDOptionsTypeNone);
+	if (manager == NULL)
+		return NULL;
+
+	match = CFDictionaryCreateMutable(kCFAllocatorDefault, 0,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	vendorRef = CFNumberCreate(kCFAllocatorDefault, kCFNumberSInt32Type, &vendor);
+	productRef = CFNumberCreate(kCFAllocatorDefault, kCFNumberSInt32Type, &product);
+	CFDictionarySetValue(match, CFSTR(kIOHIDVendorIDKey), vendorRef);
+	CFDictionarySetValue(match, CFSTR(kIOHIDProductIDKey), productRef);
+	IOHIDManagerSetDeviceMatching(manager, match);
+	CFRelease(vendorRef);
+	CFRelease(productRef);
+	CFRelease(match);
+
+	return manager;
+}
+
+CFIndex co2CopyDevices(IOHIDManagerRef manager, IOHIDDeviceRef *devices,
+	CFIndex max)
+{
+	CFSetRef set;
+	CFIndex count, i;
+	const void **values;
+
+	set = IOHIDManagerCopyDevices(manager);
+	if (set == NULL)
+		return 0;
+
+	count = CFSetGetCount(set);
+	values = malloc(sizeof(*values) * count);
+	CFSetGetValues(set, values);
+	if (count > max)
+		count = max;
+	for (i = 0; i < count; i++) {
+		devices[i] = (IOHIDDeviceRef)values[i];
+		CFRetain(devices[i]);
+	}
+	free(values);
+	CFRelease(set);
+
+	return count;
+}
+
+int co2DevicePath(IOHIDDeviceRef device, char *path)
+{
+	io_service_t service;
+
+	service = IOHIDDeviceGetService(device);
+	if (service == MACH_PORT_NULL)
+		return -1;
+
+	return IORegistryEntryGetPath(service, kIOServicePlane, path) ==
+		KERN_SUCCESS ? 0 : -1;
+}
+
+CFRunLoopRef co2Schedule(IOHIDDeviceRef device, uint8_t *buffer,
+	CFIndex length, uintptr_t handle)
+{
+	CFRunLoopRef runLoop = CFRunLoopGetCurrent();
+
+	IOHIDDeviceRegisterInputReportCallback(device, buffer, length,
+		inputReportCallback, (void *)handle);
+	IOHIDDeviceRegisterRemovalCallback(device, removalCallback,
+		(void *)handle);
+	IOHIDDeviceScheduleWithRunLoop(device, runLoop, kCFRunLoopDefaultMode);
+
+	return runLoop;
+}
+
+void co2Run(double seconds)
+{
+	CFRunLoopRunInMode(kCFRunLoopDefaultMode, seconds, false);
+}
+
+void co2Unschedule(IOHIDDeviceRef device, CFRunLoopRef runLoop)
+{
+	IOHIDDeviceRegisterInputReportCallback(device, NULL, 0, NULL, NULL);
+	IOHIDDeviceRegisterRemovalCallback(device, NULL, NULL);
+	IOHIDDeviceUnscheduleFromRunLoop(device, runLoop, kCFRunLoopDefaultMode);
+}
+
+static CFTypeRef property(IOHIDDeviceRef device, const char *key)
+{
+	CFStringRef keyRef;
+	CFTypeRef value;
+
+	keyRef = CFStringCreateWithCString(kCFAllocatorDefault, key,
+		kCFStringEncodingUTF8);
+	value = IOHIDDeviceGetProperty(device, keyRef);
+	CFRelease(keyRef);
+
+	return value;
+}
+
+int32_t co2IntProperty(IOHIDDeviceRef device, const char *key)
+{
+	CFTypeRef value = property(device, key);
+	int32_t n = 0;
+
+	if (value != NULL && CFGetTypeID(value) == CFNumberGetTypeID())
+		CFNumberGetValue((CFNumberRef)value, kCFNumberSInt32Type, &n);
+
+	return n;
+}
+
+int co2StringProperty(IOHIDDeviceRef device, const char *key, char *buffer,
+	CFIndex length)
+{
+	CFTypeRef value = property(device, key);
+
+	if (value == NULL || CFGetTypeID(value) != CFStringGetTypeID())
+		return -1;
+
+	return CFStringGetCString((CFStringRef)value, buffer, length,
+		kCFStringEncodingUTF8) ? 0 : -1;
+}
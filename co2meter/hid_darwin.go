@@ -0,0 +1,269 @@
+//go:build cgo
+
+package co2meter
+
+/*
+#cgo LDFLAGS: -framework IOKit -framework CoreFoundation
+#include <IOKit/hid/IOHIDManager.h>
+#include <IOKit/IOKitLib.h>
+#include <stdlib.h>
+
+IOHIDManagerRef co2CreateManager(int32_t vendor, int32_t product);
+CFIndex co2CopyDevices(IOHIDManagerRef manager, IOHIDDeviceRef *devices, CFIndex max);
+int co2DevicePath(IOHIDDeviceRef device, char *path);
+CFRunLoopRef co2Schedule(IOHIDDeviceRef device, uint8_t *buffer, CFIndex length, uintptr_t handle);
+void co2Run(double seconds);
+void co2Unschedule(IOHIDDeviceRef device, CFRunLoopRef runLoop);
+int32_t co2IntProperty(IOHIDDeviceRef device, const char *key);
+int co2StringProperty(IOHIDDeviceRef device, const char *key, char *buffer, CFIndex length);
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/cgo"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+const (
+	maxDevices   = 16
+	reportLength = 8
+)
+
+var errDeviceRemoved = errors.New("device removed")
+
+// iohidDevice is a CO2 meter accessed through IOKit. Input reports are
+// delivered by a run loop on a dedicated OS thread and queued until read.
+type iohidDevice struct {
+	manager C.IOHIDManagerRef
+	device  C.IOHIDDeviceRef
+	buffer  *C.uint8_t
+	handle  cgo.Handle
+
+	reports chan []byte
+	pending []byte
+
+	removed    chan struct{}
+	removeOnce sync.Once
+	closed     chan struct{}
+	closeOnce  sync.Once
+	stopped    chan struct{}
+}
+
+func openManager() (C.IOHIDManagerRef, error) {
+	manager := C.co2CreateManager(VendorID, ProductID)
+	if manager == 0 {
+		return 0, errors.New("IOHIDManagerCreate failed")
+	}
+	if ret := C.IOHIDManagerOpen(manager, C.kIOHIDOptionsTypeNone); ret != C.kIOReturnSuccess {
+		C.CFRelease(C.CFTypeRef(manager))
+		return 0, fmt.Errorf("IOHIDManagerOpen failed: 0x%x", uint32(ret))
+	}
+
+	return manager, nil
+}
+
+// copyDevices returns the attached meters, which have to be released.
+func copyDevices(manager C.IOHIDManagerRef) []C.IOHIDDeviceRef {
+	var devices [maxDevices]C.IOHIDDeviceRef
+
+	n := int(C.co2CopyDevices(manager, &devices[0], maxDevices))
+	return devices[:n]
+}
+
+func devicePath(device C.IOHIDDeviceRef) (string, bool) {
+	var buffer [512]C.char // io_string_t
+
+	if C.co2DevicePath(device, &buffer[0]) != 0 {
+		return "", false
+	}
+	return C.GoString(&buffer[0]), true
+}
+
+// FindMeters returns the IORegistry paths of all attached meters.
+func FindMeters() ([]string, error) {
+	manager, err := openManager()
+	if err != nil {
+		return nil, err
+	}
+	defer C.CFRelease(C.CFTypeRef(manager))
+
+	var paths []string
+	for _, device := range copyDevices(manager) {
+		if path, ok := devicePath(device); ok {
+			paths = append(paths, path)
+		}
+		C.CFRelease(C.CFTypeRef(device))
+	}
+
+	return paths, nil
+}
+
+// openHID opens the CO2 meter whose IORegistry path in the IOService plane
+// matches path. The paths of all attached meters are listed in the error if
+// none matches.
+func openHID(path string) (hid, error) {
+	manager, err := openManager()
+	if err != nil {
+		return nil, err
+	}
+
+	var device C.IOHIDDeviceRef
+	var available []string
+
+	for _, candidate := range copyDevices(manager) {
+		if candidatePath, ok := devicePath(candidate); ok {
+			if device == 0 && candidatePath == path {
+				device = candidate
+				continue
+			}
+			available = append(available, candidatePath)
+		}
+		C.CFRelease(C.CFTypeRef(candidate))
+	}
+
+	if device == 0 {
+		C.CFRelease(C.CFTypeRef(manager))
+		return nil, fmt.Errorf("no CO2 meter found at %s (available: %s)", path, strings.Join(available, ", "))
+	}
+
+	if ret := C.IOHIDDeviceOpen(device, C.kIOHIDOptionsTypeNone); ret != C.kIOReturnSuccess {
+		C.CFRelease(C.CFTypeRef(device))
+		C.CFRelease(C.CFTypeRef(manager))
+		return nil, fmt.Errorf("IOHIDDeviceOpen failed: 0x%x", uint32(ret))
+	}
+
+	d := &iohidDevice{
+		manager: manager,
+		device:  device,
+		buffer:  (*C.uint8_t)(C.malloc(reportLength)),
+		reports: make(chan []byte, 64),
+		removed: make(chan struct{}),
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	d.handle = cgo.NewHandle(d)
+
+	go d.run()
+
+	return d, nil
+}
+
+func (d *iohidDevice) run() {
+	// Run loops are bound to a thread, so keep this goroutine on one
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer close(d.stopped)
+
+	runLoop := C.co2Schedule(d.device, d.buffer, reportLength, C.uintptr_t(d.handle))
+	for {
+		select {
+		case <-d.closed:
+			C.co2Unschedule(d.device, runLoop)
+			return
+		default:
+			C.co2Run(0.25)
+		}
+	}
+}
+
+func (d *iohidDevice) intProperty(key string) int32 {
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+
+	return int32(C.co2IntProperty(d.device, cKey))
+}
+
+func (d *iohidDevice) stringProperty(key string) string {
+	var buffer [256]C.char
+
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+
+	if C.co2StringProperty(d.device, cKey, &buffer[0], C.CFIndex(len(buffer))) != 0 {
+		return ""
+	}
+	return C.GoString(&buffer[0])
+}
+
+func (d *iohidDevice) Info() (Info, error) {
+	return Info{
+		Vendor:  uint16(d.intProperty(C.kIOHIDVendorIDKey)),
+		Product: uint16(d.intProperty(C.kIOHIDProductIDKey)),
+		Serial:  d.stringProperty(C.kIOHIDSerialNumberKey),
+		Name: strings.TrimSpace(d.stringProperty(C.kIOHIDManufacturerKey) + " " +
+			d.stringProperty(C.kIOHIDProductKey)),
+	}, nil
+}
+
+func (d *iohidDevice) SendKey(reportNumber byte, key []byte) error {
+	ret := C.IOHIDDeviceSetReport(
+		d.device,
+		C.kIOHIDReportTypeFeature,
+		C.CFIndex(reportNumber),
+		(*C.uint8_t)(unsafe.Pointer(&key[0])),
+		C.CFIndex(len(key)),
+	)
+	if ret != C.kIOReturnSuccess {
+		return fmt.Errorf("IOHIDDeviceSetReport failed: 0x%x", uint32(ret))
+	}
+
+	return nil
+}
+
+func (d *iohidDevice) Read(p []byte) (int, error) {
+	if len(d.pending) == 0 {
+		select {
+		case report := <-d.reports:
+			d.pending = report
+		case <-d.removed:
+			return 0, errDeviceRemoved
+		case <-d.closed:
+			return 0, os.ErrClosed
+		}
+	}
+
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *iohidDevice) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		<-d.stopped
+
+		C.IOHIDDeviceClose(d.device, C.kIOHIDOptionsTypeNone)
+		C.CFRelease(C.CFTypeRef(d.device))
+		C.CFRelease(C.CFTypeRef(d.manager))
+		C.free(unsafe.Pointer(d.buffer))
+		d.handle.Delete()
+	})
+
+	return nil
+}
+
+//export co2InputReport
+func co2InputReport(handle C.uintptr_t, report *C.uint8_t, length C.CFIndex) {
+	d := cgo.Handle(handle).Value().(*iohidDevice)
+
+	select {
+	case d.reports <- C.GoBytes(unsafe.Pointer(report), C.int(length)):
+	default:
+		// Nobody is reading, drop the report
+	}
+}
+
+//export co2DeviceRemoved
+func co2DeviceRemoved(handle C.uintptr_t) {
+	d := cgo.Handle(handle).Value().(*iohidDevice)
+
+	d.removeOnce.Do(func() {
+		close(d.removed)
+	})
+}
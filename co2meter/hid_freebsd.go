@@ -0,0 +1,86 @@
+package co2meter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// usbGenDescriptor mirrors struct usb_gen_descriptor from <dev/usb/usb_ioctl.h>.
+type usbGenDescriptor struct {
+	data        unsafe.Pointer
+	langID      uint16
+	maxLen      uint16
+	actLen      uint16
+	offset      uint16
+	configIndex uint8
+	stringIndex uint8
+	ifaceIndex  uint8
+	altifIndex  uint8
+	endptIndex  uint8
+	reportType  uint8
+	reserved    [8]uint8
+}
+
+const (
+	// USB_SET_REPORT is _IOW('U', 24, struct usb_gen_descriptor)
+	usbSetReport = 0x80000000 | (unsafe.Sizeof(usbGenDescriptor{})&0x1fff)<<16 | 'U'<<8 | 24
+
+	uhidFeatureReport = 0x03
+)
+
+// uhidDevice is a CO2 meter accessed through the FreeBSD uhid(4) driver.
+type uhidDevice struct {
+	*os.File
+}
+
+func openHID(path string) (hid, error) {
+	source, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return uhidDevice{source}, nil
+}
+
+func FindMeters() ([]string, error) {
+	return nil, errors.New("detecting meters is not supported on FreeBSD")
+}
+
+func (d uhidDevice) SendKey(reportNumber byte, key []byte) error {
+	// uhid expects the report data only for report number zero, and the
+	// report number in front of the data otherwise
+	report := make([]byte, 0, 1+len(key))
+	if reportNumber != 0 {
+		report = append(report, reportNumber)
+	}
+	report = append(report, key...)
+
+	desc := usbGenDescriptor{
+		data:       unsafe.Pointer(&report[0]),
+		maxLen:     uint16(len(report)),
+		reportType: uhidFeatureReport,
+	}
+
+	// Retry when interrupted by a signal. Reads need no such care, as
+	// os.File retries them itself.
+	for {
+		_, _, errno := syscall.Syscall(
+			syscall.SYS_IOCTL,
+			uintptr(d.Fd()),
+			usbSetReport,
+			uintptr(unsafe.Pointer(&desc)),
+		)
+		runtime.KeepAlive(report)
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR:
+			continue
+		}
+		return fmt.Errorf("ioctl failed: %w", errno)
+	}
+}
@@ -0,0 +1,144 @@
+package co2meter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// hidrawDevinfo mirrors struct hidraw_devinfo from <linux/hidraw.h>.
+type hidrawDevinfo struct {
+	bustype uint32
+	vendor  uint16
+	product uint16
+}
+
+const (
+	// HIDIOCGRAWINFO is _IOR('H', 0x03, struct hidraw_devinfo)
+	hidiocgrawinfo = 0x80000000 | unsafe.Sizeof(hidrawDevinfo{})<<16 | 'H'<<8 | 0x03
+)
+
+// hidiocgrawname returns HIDIOCGRAWNAME(len), which reads the device name
+// made up of manufacturer and product.
+func hidiocgrawname(size int) uintptr {
+	return 0x80000000 | uintptr(size)<<16 | 'H'<<8 | 0x04
+}
+
+// hidiocgrawuniq returns HIDIOCGRAWUNIQ(len), which reads the serial number.
+func hidiocgrawuniq(size int) uintptr {
+	return 0x80000000 | uintptr(size)<<16 | 'H'<<8 | 0x08
+}
+
+// hidiocsfeature returns HIDIOCSFEATURE(len), which sends a feature report.
+// More info: https://www.kernel.org/doc/Documentation/hid/hidraw.txt
+func hidiocsfeature(size int) uintptr {
+	return 0xC0000000 | uintptr(size)<<16 | 'H'<<8 | 0x06
+}
+
+// hidrawDevice is a CO2 meter accessed through the Linux hidraw driver.
+type hidrawDevice struct {
+	*os.File
+}
+
+func openHID(path string) (hid, error) {
+	source, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return hidrawDevice{source}, nil
+}
+
+// FindMeters returns the hidraw devices whose USB IDs match the meter.
+func FindMeters() ([]string, error) {
+	candidates, err := filepath.Glob("/dev/hidraw*")
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, path := range candidates {
+		info, err := hidrawInfo(path)
+		if err != nil {
+			continue
+		}
+		if info.IsMeter() {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, nil
+}
+
+func hidrawInfo(path string) (Info, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer source.Close()
+
+	return hidrawDevice{source}.Info()
+}
+
+// ioctl issues an ioctl on source, retrying when interrupted by a signal.
+// Reads need no such care, as os.File retries them itself.
+func ioctl(source *os.File, request uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, source.Fd(), request, uintptr(arg))
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR:
+			continue
+		}
+		return fmt.Errorf("ioctl failed: %w", errno)
+	}
+}
+
+func (d hidrawDevice) Info() (Info, error) {
+	var raw hidrawDevinfo
+
+	if err := ioctl(d.File, hidiocgrawinfo, unsafe.Pointer(&raw)); err != nil {
+		return Info{}, err
+	}
+	info := Info{Vendor: raw.vendor, Product: raw.product}
+
+	var name [256]byte
+	if ioctl(d.File, hidiocgrawname(len(name)), unsafe.Pointer(&name)) == nil {
+		info.Name = cString(name[:])
+	}
+
+	// Older kernels lack HIDIOCGRAWUNIQ, leave the serial empty there
+	var uniq [256]byte
+	if ioctl(d.File, hidiocgrawuniq(len(uniq)), unsafe.Pointer(&uniq)) == nil {
+		info.Serial = cString(uniq[:])
+	}
+
+	return info, nil
+}
+
+func cString(buffer []byte) string {
+	if i := bytes.IndexByte(buffer, 0); i >= 0 {
+		buffer = buffer[:i]
+	}
+	return string(buffer)
+}
+
+func (d hidrawDevice) SendKey(reportNumber byte, key []byte) error {
+	return hidSetReport(d.File, reportNumber, key)
+}
+
+func hidSetReport(source *os.File, reportNumber byte, key []byte) error {
+	// Prepare report buffer. Buffer cannot be slice object, since it will be
+	// passed to kernel
+
+	var report [1 + KeySize]byte
+	report[0] = reportNumber
+	copy(report[1:], key) // rest of report is random 8 byte key
+
+	// Issue HID SET_REPORT on device
+	return ioctl(source, hidiocsfeature(len(report)), unsafe.Pointer(&report))
+}
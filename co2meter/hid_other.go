@@ -0,0 +1,15 @@
+//go:build !linux && !windows && !freebsd && !(darwin && cgo)
+
+package co2meter
+
+import (
+	"errors"
+)
+
+func openHID(path string) (hid, error) {
+	return nil, errors.New("HID devices are not supported on this platform")
+}
+
+func FindMeters() ([]string, error) {
+	return nil, errors.New("HID devices are not supported on this platform")
+}
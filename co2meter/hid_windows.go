@@ -0,0 +1,180 @@
+package co2meter
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	hidDLL = windows.NewLazySystemDLL("hid.dll")
+
+	procHidDGetHidGuid            = hidDLL.NewProc("HidD_GetHidGuid")
+	procHidDGetAttributes         = hidDLL.NewProc("HidD_GetAttributes")
+	procHidDGetSerialNumberString = hidDLL.NewProc("HidD_GetSerialNumberString")
+	procHidDGetManufacturerString = hidDLL.NewProc("HidD_GetManufacturerString")
+	procHidDGetProductString      = hidDLL.NewProc("HidD_GetProductString")
+	procHidDSetFeature            = hidDLL.NewProc("HidD_SetFeature")
+)
+
+// hiddAttributes mirrors HIDD_ATTRIBUTES from <hidsdi.h>.
+type hiddAttributes struct {
+	size          uint32
+	vendorID      uint16
+	productID     uint16
+	versionNumber uint16
+}
+
+// hidDevice is a CO2 meter accessed through the Windows HID class driver.
+type hidDevice struct {
+	handle  windows.Handle
+	buffer  [9]byte
+	pending []byte
+}
+
+// openHID accepts either a device interface path (\\?\hid#vid_04d9&...) or a
+// device instance ID (HID\VID_04D9&PID_A052\...), which is resolved to the
+// path of its HID interface.
+func openHID(path string) (hid, error) {
+	if !strings.HasPrefix(path, `\\`) {
+		var err error
+		path, err = hidInterfacePath(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := windows.CreateFile(
+		name,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil,
+		windows.OPEN_EXISTING,
+		0,
+		0,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+
+	return &hidDevice{handle: handle}, nil
+}
+
+func hidGUID() *windows.GUID {
+	var guid windows.GUID
+	procHidDGetHidGuid.Call(uintptr(unsafe.Pointer(&guid)))
+	return &guid
+}
+
+// FindMeters returns the paths of all HID interfaces whose USB IDs match
+// the meter.
+func FindMeters() ([]string, error) {
+	interfaces, err := windows.CM_Get_Device_Interface_List("", hidGUID(), windows.CM_GET_DEVICE_INTERFACE_LIST_PRESENT)
+	if err != nil {
+		return nil, err
+	}
+
+	id := fmt.Sprintf("vid_%04x&pid_%04x", VendorID, ProductID)
+
+	var paths []string
+	for _, path := range interfaces {
+		if strings.Contains(strings.ToLower(path), id) {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, nil
+}
+
+func hidInterfacePath(instanceID string) (string, error) {
+	paths, err := windows.CM_Get_Device_Interface_List(instanceID, hidGUID(), windows.CM_GET_DEVICE_INTERFACE_LIST_PRESENT)
+	if err != nil {
+		return "", fmt.Errorf("looking up HID interface of %s: %w", instanceID, err)
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no HID interface found for %s", instanceID)
+	}
+
+	return paths[0], nil
+}
+
+func (d *hidDevice) Info() (Info, error) {
+	attributes := hiddAttributes{size: uint32(unsafe.Sizeof(hiddAttributes{}))}
+
+	ok, _, err := procHidDGetAttributes.Call(uintptr(d.handle), uintptr(unsafe.Pointer(&attributes)))
+	if ok == 0 {
+		return Info{}, fmt.Errorf("HidD_GetAttributes failed: %w", err)
+	}
+	info := Info{Vendor: attributes.vendorID, Product: attributes.productID}
+
+	// Meters without serial number fail this, leave the serial empty then
+	info.Serial = d.stringAttribute(procHidDGetSerialNumberString)
+	info.Name = strings.TrimSpace(d.stringAttribute(procHidDGetManufacturerString) + " " +
+		d.stringAttribute(procHidDGetProductString))
+
+	return info, nil
+}
+
+// stringAttribute returns a string read with one of the HidD_Get*String
+// functions, or an empty one if that fails.
+func (d *hidDevice) stringAttribute(proc *windows.LazyProc) string {
+	var buffer [127]uint16
+	ok, _, _ := proc.Call(
+		uintptr(d.handle),
+		uintptr(unsafe.Pointer(&buffer)),
+		uintptr(len(buffer)*2),
+	)
+	if ok == 0 {
+		return ""
+	}
+	return windows.UTF16ToString(buffer[:])
+}
+
+func (d *hidDevice) SendKey(reportNumber byte, key []byte) error {
+	var report [1 + KeySize]byte
+	report[0] = reportNumber
+	copy(report[1:], key) // rest of report is random 8 byte key
+
+	ok, _, err := procHidDSetFeature.Call(
+		uintptr(d.handle),
+		uintptr(unsafe.Pointer(&report)),
+		uintptr(len(report)),
+	)
+	if ok == 0 {
+		return fmt.Errorf("HidD_SetFeature failed: %w", err)
+	}
+
+	return nil
+}
+
+// Read returns the input reports of the meter with the leading report
+// number that Windows prepends stripped.
+func (d *hidDevice) Read(p []byte) (int, error) {
+	if len(d.pending) == 0 {
+		var n uint32
+		if err := windows.ReadFile(d.handle, d.buffer[:], &n, nil); err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		d.pending = d.buffer[1:n]
+	}
+
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *hidDevice) Close() error {
+	// Abort a pending ReadFile, which would otherwise keep the handle busy
+	windows.CancelIoEx(d.handle, nil)
+	return windows.CloseHandle(d.handle)
+}
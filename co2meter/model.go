@@ -0,0 +1,30 @@
+package co2meter
+
+import "strings"
+
+// Model is a kind of meter, as told apart by the USB name.
+type Model struct {
+	Name string
+
+	// Decoder decodes the frames of the model.
+	Decoder Decoder
+}
+
+// models maps substrings of the USB names to the known models.
+var models = []struct {
+	match string
+	model Model
+}{
+	{"USB-zyTemp", Model{Name: "zyTemp", Decoder: ZyTempDecoder}},
+}
+
+// DetectModel returns the model of a meter described by info, or false if
+// the model is unknown.
+func DetectModel(info Info) (Model, bool) {
+	for _, m := range models {
+		if strings.Contains(info.Name, m.match) {
+			return m.model, true
+		}
+	}
+	return Model{}, false
+}
@@ -1,199 +1,1253 @@
 package main
 
-// Following code is based on this great work:
-// https://hackaday.io/project/5301-reverse-engineering-a-low-cost-usb-co-monitor/log/17909-all-your-base-are-belong-to-us
-
 import (
-	"crypto/rand"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
-	"sync/atomic"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
-	"unsafe"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rnurgaliyev/co2meter_exporter/co2meter"
 )
 
 const (
-	readingInterval = time.Millisecond * 200
-	reportInterval  = time.Second * 5
+	readingInterval     = time.Millisecond * 200
+	reportInterval      = time.Second * 5
+	reconnectMinBackoff = time.Second * 1
+	reconnectMaxBackoff = time.Second * 30
+	hotplugInterval     = time.Second * 2
+	shutdownTimeout     = time.Second * 5
 )
 
-var co2 atomic.Int32
-var rawTemperature atomic.Int32
+// Set at build time with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=...". Builds done by go install fall back to the module
+// version and VCS information embedded by the go tool.
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
 
-func Co2() float64 {
-	return float64(co2.Load())
+	if version == "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && commit == "":
+			commit = setting.Value
+		case setting.Key == "vcs.time" && date == "":
+			date = setting.Value
+		}
+	}
 }
 
-func Temperature() float64 {
-	return math.Round((float64(rawTemperature.Load())/16.0-273.15)*100) / 100
+var metricNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// metricName returns the name of a metric below the configured namespace,
+// subsystem and prefix, which is co2meter_<name> by default.
+func metricName(name string) string {
+	return prometheus.BuildFQName(*metricNamespaceFlag, *metricSubsystemFlag,
+		prometheus.BuildFQName(*metricPrefixFlag, "", name))
 }
 
+// Created by newCounters, as their names depend on flags
 var (
-	co2Gauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-		Name: "co2meter_co2_ppms",
-		Help: "CO2 reading in PPM.",
-	}, Co2)
-
-	temperatureGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-		Name: "co2meter_temperature_celsius",
-		Help: "Temperature reading in degree celsius.",
-	}, Temperature)
+	invalidReadingsCounter *prometheus.CounterVec
+	reconnectsCounter      *prometheus.CounterVec
+	readTimeoutsCounter    *prometheus.CounterVec
+	readErrorsCounter      *prometheus.CounterVec
+	stateChangesCounter    *prometheus.CounterVec
+	unknownFramesCounter   *prometheus.CounterVec
+	readingsCounter        *prometheus.CounterVec
+	outliersCounter        *prometheus.CounterVec
+	implausibleCounter     *prometheus.CounterVec
+	droppedReadingsCounter *prometheus.CounterVec
+	co2Histogram           *prometheus.HistogramVec
+	scrapeDuration         *prometheus.HistogramVec
+	scrapesCounter         *prometheus.CounterVec
 )
 
-func decryptReading(buffer []byte, key []byte) []byte {
-	var cstate = []byte{0x48, 0x74, 0x65, 0x6D, 0x70, 0x39, 0x39, 0x65}
-	var shuffle = []byte{2, 4, 0, 7, 1, 6, 5, 3}
+// newCounters creates the counters, and the CO2 histogram if any buckets
+// are given.
+func newCounters(co2Buckets []float64) {
+	invalidReadingsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("invalid_readings_total"),
+		Help: "Number of frames that failed decryption or checksum validation.",
+	}, stateLabels)
+
+	reconnectsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("device_reconnects_total"),
+		Help: "Number of times the device was reopened after a read error.",
+	}, stateLabels)
+
+	readTimeoutsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("read_timeouts_total"),
+		Help: "Number of times the device sent no frame within the read timeout.",
+	}, stateLabels)
+
+	readErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("read_errors_total"),
+		Help: "Number of failed reads and invalid frames by reason (eof, timeout, short_read, io, decrypt, checksum).",
+	}, append(append([]string{}, stateLabels...), "reason"))
+
+	stateChangesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("device_state_changes_total"),
+		Help: "Number of times the device got connected or disconnected.",
+	}, append(append([]string{}, stateLabels...), "state"))
+
+	unknownFramesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("unknown_frames_total"),
+		Help: "Number of valid frames with an unknown code, by the code.",
+	}, append(append([]string{}, stateLabels...), "code"))
+
+	readingsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("readings_total"),
+		Help: "Number of readings received, by the kind of reading.",
+	}, append(append([]string{}, stateLabels...), "kind"))
+
+	outliersCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("outliers_rejected_total"),
+		Help: "Number of CO2 readings rejected as outliers with -median-window.",
+	}, stateLabels)
+
+	implausibleCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("implausible_readings_total"),
+		Help: "Number of readings dropped for being out of the plausible bounds, by the kind of reading.",
+	}, append(append([]string{}, stateLabels...), "kind"))
+
+	droppedReadingsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("dropped_readings_total"),
+		Help: "Number of readings dropped by internal subscribers that could not keep up, by the subscriber.",
+	}, []string{"subscriber"})
 
-	phase1 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	for i, j := range shuffle {
-		phase1[j] = buffer[i]
+	goroutinePanicsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("goroutine_panics_total"),
+		Help: "Number of panics recovered in background goroutines, which are restarted.",
+	}, []string{"goroutine"})
+
+	readerRestartsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("device_reader_restarts_total"),
+		Help: "Number of times the reader of the device was restarted, after a fatal read error or a panic.",
+	}, stateLabels)
+
+	scrapeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: metricName("scrape_duration_seconds"),
+		Help: "Time taken to serve /metrics.",
+	}, nil)
+
+	scrapesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricName("scrapes_total"),
+		Help: "Number of requests to /metrics.",
+	}, nil)
+
+	if len(co2Buckets) > 0 {
+		co2Histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    metricName("co2_ppm_histogram"),
+			Help:    "Distribution of the CO2 readings in PPM.",
+			Buckets: co2Buckets,
+		}, stateLabels)
 	}
+}
 
-	phase2 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	for i := range shuffle {
-		phase2[i] = phase1[i] ^ key[i]
+// parseBuckets parses a comma separated list of increasing bucket bounds.
+func parseBuckets(list string) ([]float64, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	var buckets []float64
+	for _, field := range strings.Split(list, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket bound: %s", field)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket bounds must be increasing: %s", list)
+		}
+		buckets = append(buckets, bound)
 	}
+	return buckets, nil
+}
 
-	phase3 := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	for i := range shuffle {
-		phase3[i] = ((phase2[i] >> 3) | (phase2[(i-1+8)%8] << 5)) & 0xff
+// temperatureUnit converts the temperature, which is kept in degree celsius
+// internally, for output.
+type temperatureUnit struct {
+	name    string
+	help    string
+	symbol  string
+	convert func(celsius float64) float64
+}
+
+var temperatureUnits = map[string]temperatureUnit{
+	"c": {"celsius", "degree celsius", "C", func(c float64) float64 { return c }},
+	"f": {"fahrenheit", "degree fahrenheit", "F", func(c float64) float64 { return c*9/5 + 32 }},
+	"k": {"kelvin", "kelvin", "K", func(c float64) float64 { return c + 273.15 }},
+}
+
+// unitOfMeasurement returns the unit as shown to Home Assistant.
+func (u temperatureUnit) unitOfMeasurement() string {
+	if u.symbol == "K" {
+		return u.symbol
 	}
+	return "°" + u.symbol
+}
+
+func (u temperatureUnit) fromCelsius(celsius float64) float64 {
+	return math.Round(u.convert(celsius)*100) / 100
+}
 
-	ctmp := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	for i := range shuffle {
-		ctmp[i] = ((cstate[i] >> 4) | (cstate[i] << 4)) & 0xff
+// fromCelsiusDelta converts a temperature difference, which unlike absolute
+// temperatures has no offset between units.
+func (u temperatureUnit) fromCelsiusDelta(delta float64) float64 {
+	return u.convert(delta) - u.convert(0)
+}
+
+// calibration corrects a reading as slope*raw + intercept.
+type calibration struct {
+	slope     float64
+	intercept float64
+}
+
+func (c calibration) apply(raw float64) float64 {
+	return c.slope*raw + c.intercept
+}
+
+// identity reports whether the calibration leaves readings unchanged.
+func (c calibration) identity() bool {
+	return c.slope == 1 && c.intercept == 0
+}
+
+// kelvin16ToCelsius converts a temperature reading of the meter, which is
+// in 1/16 kelvin, to degree celsius.
+func kelvin16ToCelsius(raw int32) float64 {
+	return float64(raw)/16.0 - 273.15
+}
+
+// autoDevice is the device of the meter read with -auto when none was
+// attached at startup. It is opened once one gets plugged in.
+const autoDevice = "auto"
+
+var errNoMeter = errors.New("no CO2 meter found")
+
+// fixedKey is the key given with -key or -key-file, nil for random keys.
+var fixedKey []byte
+
+// parseKey parses a key given in hex, with optional colons or spaces
+// between the bytes.
+func parseKey(s string) ([]byte, error) {
+	s = strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(s))
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
 	}
+	if len(key) != co2meter.KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", co2meter.KeySize, len(key))
+	}
+	return key, nil
+}
 
-	out := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	for i := range shuffle {
-		out[i] = (byte)(((0x100 + (int)(phase3[i]) - (int)(ctmp[i])) & (int)(0xff)))
+// openMeter opens a meter, or with -replay-loop a capture file replayed in
+// a loop.
+func openMeter(path string) (*co2meter.Device, error) {
+	if path == autoDevice {
+		paths, err := co2meter.FindMeters()
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, errNoMeter
+		}
+		slog.Info("Found CO2 meter", "device", paths[0])
+		path = paths[0]
+	}
+	source, err := co2meter.Open(path, co2meter.Options{
+		ReportNumber: byte(*reportNumberFlag),
+		Key:          fixedKey,
+		Loop:         *replayLoopFlag,
+	})
+	if err != nil {
+		return nil, err
 	}
+	if source.IsReplay() {
+		return source, nil
+	}
+	slog.Debug("Sent key", "device", path, "report_number", *reportNumberFlag, "key", fmt.Sprintf("%x", source.Key()))
+
+	return source, nil
+}
+
+// openWithRetry opens a meter at startup, retrying with exponential backoff
+// for up to timeout, as the device may not be there yet during boot.
+func openWithRetry(path string, timeout time.Duration) (*co2meter.Device, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := reconnectMinBackoff
+	for {
+		source, err := openMeter(path)
+		remaining := time.Until(deadline)
+		if err == nil || remaining <= 0 {
+			return source, err
+		}
+		wait := min(backoff, remaining)
+		slog.Info("Opening failed, retrying", "device", path, "retry_in", wait, "err", err)
 
-	return out
+		time.Sleep(wait)
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
 }
 
-func isValidReading(buffer []byte) bool {
-	if buffer[4] != 0x0D || (buffer[0]+buffer[1]+buffer[2])&0xFF != buffer[3] {
+// listenUnix listens on a Unix domain socket, replacing a stale socket
+// left behind by a previous run. The socket is removed again when the
+// listener is closed.
+func listenUnix(path string, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %s", mode)
+	}
+
+	if stat, err := os.Stat(path); err == nil && stat.Mode().Type() == os.ModeSocket {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// sleep waits for d to elapse and reports whether ctx is still active.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
 		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// closeOnDone closes source once ctx is cancelled, which unblocks any
+// pending read on it.
+func closeOnDone(ctx context.Context, source io.Closer) func() bool {
+	return context.AfterFunc(ctx, func() {
+		source.Close()
+	})
+}
+
+// reconnect reopens the device, backing off exponentially between attempts,
+// until it succeeds or ctx is cancelled.
+func reconnect(ctx context.Context, state *envState) (*co2meter.Device, error) {
+	backoff := reconnectMinBackoff
+	for {
+		if !sleep(ctx, backoff) {
+			return nil, ctx.Err()
+		}
+
+		source, err := openMeter(state.device)
+		if err == nil {
+			state.reconnects.Inc()
+			slog.Info("Reconnected", "device", state.device)
+			return source, nil
+		}
+		// Waiting for a meter to be plugged in is no error
+		if errors.Is(err, errNoMeter) {
+			backoff = hotplugInterval
+			continue
+		}
+		slog.Error("Reconnecting failed", "device", state.device, "err", err)
+
+		backoff = min(backoff*2, reconnectMaxBackoff)
 	}
+}
 
-	return true
+// frameResult is the outcome of a read by readFrame.
+type frameResult struct {
+	frame []byte
+	err   error
 }
 
-func hidSetReport(source *os.File, key []byte) {
-	// Prepare report buffer. Buffer cannot be slice object, since it will be
-	// passed to kernel
+// readFrame reads the next frame from source. If that takes longer than
+// timeout, source is closed, and timedOut is set. The read runs in a
+// goroutine of its own, so readFrame returns once ctx is done even if
+// closing the device does not make a pending read fail, which is the case
+// for some devices. Such a read is left behind, and ends with the process.
+func readFrame(ctx context.Context, source *co2meter.Device, timeout time.Duration) (frame []byte, timedOut bool, err error) {
+	done := make(chan frameResult, 1)
+	go func() {
+		frame, err := source.ReadFrame()
+		done <- frameResult{frame, err}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
 
-	var report [9]byte    // we will send this report to ioctl HIDIOCSFEATURE(9)
-	report[0] = 0x00      // report number shall always be zero
-	copy(report[1:], key) // rest of report is random 8 byte key
+	select {
+	case result := <-done:
+		return result.frame, false, result.err
+	case <-expired:
+		source.Close()
+		return nil, true, os.ErrDeadlineExceeded
+	case <-ctx.Done():
+		source.Close()
+		return nil, false, ctx.Err()
+	}
+}
 
-	// Issue HID SET_REPORT on device
-	_, _, errno := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(source.Fd()),
-		// Following ioctl call number is equivalent to HIDIOCSFEATURE(9)
-		// more info: https://www.kernel.org/doc/Documentation/hid/hidraw.txt
-		uintptr(0xC0094806),
-		uintptr(unsafe.Pointer(&report)),
-	)
-	if errno != 0 {
-		log.Fatal("ioctl failed: ", errno)
+// decoderOf returns the decoder of the frames of the meter of state, as
+// given by -model or -skip-decryption, or detected from the USB name.
+func decoderOf(state *envState) co2meter.Decoder {
+	switch {
+	case *modelFlag != "":
+		decoder, _ := co2meter.LookupDecoder(*modelFlag)
+		return decoder
+	case *skipDecryptionFlag:
+		return co2meter.PlainDecoder
+	case state.model.Decoder != nil:
+		return state.model.Decoder
 	}
+	return co2meter.ZyTempDecoder
 }
 
-func getReadings(source *os.File, key []byte, skipDecryption bool) {
-	buffer := make([]byte, 8)
+func getReadings(ctx context.Context, state *envState, source *co2meter.Device, decoder co2meter.Decoder, interval time.Duration) {
+	state.setConnected()
+	stop := closeOnDone(ctx, source)
+	defer func() {
+		stop()
+		source.Close()
+		state.setDisconnected()
+	}()
+
+	var detector *decryptionDetector
+	if *autoDecryptFlag {
+		encrypted := decoder
+		if encrypted == co2meter.PlainDecoder {
+			encrypted = co2meter.ZyTempDecoder
+		}
+		detector = newDecryptionDetector(encrypted)
+	}
 
 	for {
-		// Every data measurement from device comes in 8 byte chunks
-		_, err := io.ReadFull(source, buffer)
+		buffer, timedOut, err := readFrame(ctx, source, *readTimeoutFlag)
 		if err != nil {
-			log.Fatal(err)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, io.EOF) && source.IsReplay() {
+				slog.Info("Replay finished", "device", state.device)
+				return
+			}
+			switch {
+			case timedOut:
+				state.readTimeouts.Inc()
+				state.readError("timeout")
+				err = fmt.Errorf("no frame within %s", *readTimeoutFlag)
+			case errors.Is(err, io.EOF):
+				state.readError("eof")
+			case errors.Is(err, io.ErrUnexpectedEOF):
+				state.readError("short_read")
+			default:
+				state.readError("io")
+			}
+			slog.Error("Reading failed", "device", state.device, "err", err)
+
+			stop()
+			source.Close()
+			state.setDisconnected()
+			readerRestartsCounter.WithLabelValues(state.labelValues()...).Inc()
+			next, err := reconnect(ctx, state)
+			if err != nil {
+				return
+			}
+			source = next
+			state.setConnected()
+			state.resetSmoothing()
+			stop = closeOnDone(ctx, source)
+			continue
 		}
 
-		var code byte
-		var value int32
-		if skipDecryption {
-			code = buffer[0]
-			value = int32(binary.BigEndian.Uint16(buffer[1:3]))
-		} else {
-			decrypted := decryptReading(buffer, key)
+		if state.recorder != nil {
+			state.recorder.record(buffer)
+		}
 
-			if !isValidReading(decrypted) {
-				log.Println("Data decryption failed: ", decrypted)
-				break
+		if detector != nil {
+			skip, conclusive, done := detector.observe(buffer, source.Key())
+			if !done {
+				continue
 			}
+			encrypted := detector.encrypted
+			detector = nil
 
-			code = decrypted[0]
-			value = int32(binary.BigEndian.Uint16(decrypted[1:3]))
+			if conclusive {
+				decoder = encrypted
+				if skip {
+					decoder = co2meter.PlainDecoder
+				}
+				slog.Info("Detected frame encryption", "device", state.device, "decryption", !skip)
+			} else {
+				slog.Warn("Detecting frame encryption failed, using -skip-decryption", "device", state.device,
+					"decryption", decoder != co2meter.PlainDecoder)
+			}
 		}
 
-		switch code {
-		case 0x50:
-			// Got CO2 reading (code 0x50)
-			co2.Store(value)
-		case 0x42:
-			// Got temperature reading (code 0x42)
-			rawTemperature.Store(value)
+		frame := buffer
+		var decrypted []byte
+		if decoder != co2meter.PlainDecoder {
+			decrypted = decoder.Decode(buffer, source.Key())
+			frame = decrypted
+
+			if err := co2meter.CheckFrame(decrypted); err != nil {
+				if *debugFramesFlag {
+					slog.Debug("Frame", "device", state.device, "raw", fmt.Sprintf("%x", buffer), "decrypted", fmt.Sprintf("%x", decrypted))
+				}
+				if errors.Is(err, co2meter.ErrChecksum) {
+					slog.Warn("Frame checksum mismatch", "device", state.device, "frame", fmt.Sprintf("%x", decrypted))
+					state.readError("checksum")
+				} else {
+					slog.Warn("Data decryption failed", "device", state.device, "frame", fmt.Sprintf("%x", decrypted))
+					state.readError("decrypt")
+				}
+				state.invalidReadings.Inc()
+				continue
+			}
+		}
+
+		reading := co2meter.ParseFrame(frame)
+		value := reading.Value
+
+		if *debugFramesFlag {
+			slog.Debug("Frame", "device", state.device, "raw", fmt.Sprintf("%x", buffer), "decrypted", fmt.Sprintf("%x", decrypted),
+				"code", fmt.Sprintf("0x%02x", reading.Code), "value", value)
+		}
+		if reading.Kind == co2meter.Unknown {
+			code := fmt.Sprintf("0x%02x", reading.Code)
+			slog.Debug("Unknown frame", "device", state.device, "code", code, "value", value, "frame", fmt.Sprintf("%x", frame))
+			unknownFramesCounter.WithLabelValues(append(state.labelValues(), code)...).Inc()
+		} else {
+			readingsCounter.WithLabelValues(append(state.labelValues(), reading.Kind.String())...).Inc()
+		}
+
+		broadcast.publish(readingEvent{state, reading})
+		systemd.frameDecoded()
+
+		if !sleep(ctx, interval) {
+			return
 		}
-		time.Sleep(readingInterval)
 	}
 }
 
-func logMetrics() {
-	for {
-		time.Sleep(reportInterval)
-		log.Printf("CO2: %.0f ppm,\tTemperature: %.02f C\n", Co2(), Temperature())
+// readOnce waits until every meter reported CO2 and temperature, and prints
+// the readings to stdout.
+func readOnce(ctx context.Context, timeout time.Duration, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, state := range states {
+		for !state.hasCo2.Load() || !state.hasTemperature.Load() {
+			if !sleep(ctx, interval) {
+				return fmt.Errorf("no reading from %s within %s", state.device, timeout)
+			}
+		}
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(allReadings())
+}
+
+// logSink logs the readings of the meters every report interval.
+type logSink struct {
+	unit    temperatureUnit
+	updated updatedMeters
+}
+
+func (l *logSink) Publish(event readingEvent) {
+	l.updated.add(event.state)
+}
+
+func (l *logSink) Flush(ctx context.Context) {
+	for _, state := range l.updated.take() {
+		l.log(state)
+	}
+}
+
+func (l *logSink) log(state *envState) {
+	var prefix string
+	if len(states) > 1 {
+		prefix = state.name() + ": "
+	}
+	// The text format keeps the traditional line, JSON gets the readings
+	// as fields.
+	if *logFormatFlag == "json" {
+		slog.Debug("Reading", "device", state.device, "location", state.location,
+			"co2", state.Co2(), "temperature", l.unit.fromCelsius(state.Temperature()), "unit", l.unit.name)
+		return
+	}
+	// The line bypasses slog, so it has to honour -log-level on its own,
+	// at the debug level of the readings in JSON
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	log.Printf("%sCO2: %.0f ppm,\tTemperature: %.02f %s\n", prefix, state.Co2(), l.unit.fromCelsius(state.Temperature()), l.unit.symbol)
+}
+
+// enabledSinks subscribes the collector and the outputs enabled by the
+// flags to the applied readings.
+func enabledSinks(unit temperatureUnit, registry *prometheus.Registry, collector *co2Collector) []namedSink {
+	sinks := []namedSink{subscribeSink("prometheus", collector)}
+	if !*quietFlag {
+		sinks = append(sinks, subscribeSink("logger", &logSink{unit: unit}))
+	}
+	if *csvFlag != "" {
+		csv, err := newCSVSink(*csvFlag, unit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, subscribeSink("csv", csv))
+	}
+	if *mqttBrokerFlag != "" {
+		sinks = append(sinks, subscribeSink("mqtt", newMQTTSink(unit)))
+	}
+	if *influxURLFlag != "" {
+		sinks = append(sinks, subscribeSink("influx", newInfluxSink(*reportIntervalFlag)))
+	}
+	if *pushgatewayURLFlag != "" {
+		sinks = append(sinks, subscribeSink("pushgateway", newPushSink(registry)))
+	}
+	if *remoteWriteURLFlag != "" {
+		sinks = append(sinks, subscribeSink("remote-write", newRemoteWriteSink(registry, *reportIntervalFlag)))
 	}
+	if *alertWebhookFlag != "" {
+		sinks = append(sinks, subscribeSink("alert", newAlertSink()))
+	}
+	if *graphiteAddressFlag != "" {
+		sinks = append(sinks, subscribeSink("graphite", &graphiteSink{unit: unit}))
+	}
+	return sinks
+}
+
+// stringListFlag collects the values of a flag given several times, each
+// of which may also be a comma separated list.
+type stringListFlag []string
+
+func (l *stringListFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringListFlag) Set(value string) error {
+	*l = append(*l, strings.Split(value, ",")...)
+	return nil
+}
+
+func stringList(name string, usage string) *stringListFlag {
+	l := new(stringListFlag)
+	flag.Var(l, name, usage)
+	return l
 }
 
-var deviceFlag = flag.String("d", "", "device to get readings from")
+var configFlag = flag.String("config", "", "YAML file with flag values, keyed by the flag names")
+var deviceFlag = stringList("d", "device to get readings from, may be given several times")
+var autoFlag = flag.Bool("auto", false, "read from all attached CO2 meters if no device is given")
+var forceFlag = flag.Bool("force", false, "read from devices even if their USB IDs are not those of a CO2 meter")
 var hostFlag = flag.String("h", "::", "host to bind to")
 var portFlag = flag.String("p", "9200", "port to bind to")
+var listenFlag = stringList("listen", "address to serve on instead of -h and -p, e.g. [fd00::1]:9200, may be given several times")
+var unixSocketFlag = flag.String("unix-socket", "", "Unix domain socket to serve on instead of TCP")
+var unixSocketModeFlag = flag.String("unix-socket-mode", "0660", "permissions of the Unix domain socket")
+var streamMaxClientsFlag = flag.Int("stream-max-clients", 16, "maximum number of concurrent clients of /stream")
+var dashboardFlag = flag.Bool("dashboard", false, "serve a page showing the current readings on /")
+var historySizeFlag = flag.Int("history-size", 0, "number of CO2 readings kept for /history, 0 disables it")
+var disableCompressionFlag = flag.Bool("disable-compression", false, "do not gzip /metrics responses even if the scraper accepts it")
+var readingTimestampsFlag = flag.Bool("reading-timestamps", false, "attach the time of the last reading to the samples instead of leaving it to the scrape time")
+var disableGoMetricsFlag = flag.Bool("disable-go-metrics", false, "do not export the go_* and process_* metrics of the exporter itself")
+var maxScrapesFlag = flag.Float64("max-scrapes-per-second", 0, "scrapes of /metrics allowed per second, more get status 429, 0 for no limit")
+var accessLogFlag = flag.Bool("access-log", false, "log every HTTP request")
+var pprofFlag = flag.Bool("pprof", false, "serve profiling data on /debug/pprof/")
+var tlsCertFlag = flag.String("tls-cert", "", "TLS certificate file to serve HTTPS with")
+var tlsKeyFlag = flag.String("tls-key", "", "TLS key file to serve HTTPS with")
+var tlsClientCAFlag = flag.String("tls-client-ca", "", "CA file to verify client certificates against, enables mutual TLS")
+var authUserFlag = flag.String("auth-user", "", "user for HTTP basic auth")
+var authPassFlag = flag.String("auth-pass", "", "password for HTTP basic auth")
+var authHtpasswdFlag = flag.String("auth-htpasswd", "", "htpasswd file with bcrypt hashed passwords for HTTP basic auth")
+var metricNamespaceFlag = flag.String("metric-namespace", "", "namespace prepended to all metric names")
+var metricSubsystemFlag = flag.String("metric-subsystem", "", "subsystem prepended to all metric names, after the namespace")
+var metricPrefixFlag = flag.String("metric-prefix", "co2meter", "prefix of all metric names, after namespace and subsystem")
+var legacyMetricNamesFlag = flag.Bool("legacy-metric-names", true, "also export the deprecated co2meter_co2_ppms metric")
+var smoothWindowFlag = flag.Int("smooth-window", 0, "number of CO2 readings to average for co2meter_co2_ppm_smoothed, 0 disables smoothing")
+var co2MinFlag = flag.Int("co2-min", 0, "lowest plausible CO2 reading in PPM, lower ones are dropped")
+var co2MaxFlag = flag.Int("co2-max", 40000, "highest plausible CO2 reading in PPM, higher ones are dropped")
+var tempMinFlag = flag.Float64("temp-min", -40, "lowest plausible temperature reading in degree celsius, lower ones are dropped")
+var tempMaxFlag = flag.Float64("temp-max", 85, "highest plausible temperature reading in degree celsius, higher ones are dropped")
+var medianWindowFlag = flag.Int("median-window", 0, "number of CO2 readings whose median outliers are rejected against, 0 disables it")
+var outlierThresholdFlag = flag.Int("outlier-threshold", 1000, "PPM a CO2 reading may differ from the median of -median-window before it is rejected")
+var ewmaAlphaFlag = flag.Float64("ewma-alpha", 0, "smoothing factor (0..1) of co2meter_co2_ppm_ewma, 0 disables it")
+var windowFlag = flag.Duration("window", 0, "time window of the min and max CO2 and temperature metrics, 0 disables them")
+var co2BucketsFlag = flag.String("co2-buckets", "", "comma separated upper bounds in PPM of the co2meter_co2_ppm_histogram buckets, empty disables it")
+var co2OffsetFlag = flag.Int("co2-offset", 0, "offset in PPM added to the CO2 readings")
+var co2SlopeFlag = flag.Float64("co2-slope", 1, "factor the CO2 readings are multiplied with before adding the intercept")
+var co2InterceptFlag = flag.Float64("co2-intercept", 0, "intercept in PPM added to the CO2 readings after applying the slope")
+var pressureFlag = flag.Float64("pressure", 0, "air pressure in hPa at the meters, the CO2 readings are corrected for, 0 for standard pressure")
+var altitudeFlag = flag.Float64("altitude", 0, "altitude in meters of the meters, to correct the CO2 readings for the air pressure there")
+var tempOffsetFlag = flag.Float64("temp-offset", 0, "offset in degree celsius added to the temperature readings")
+var tempSlopeFlag = flag.Float64("temp-slope", 1, "factor the temperature readings in degree celsius are multiplied with before adding the intercept")
+var tempInterceptFlag = flag.Float64("temp-intercept", 0, "intercept in degree celsius added to the temperature readings after applying the slope")
+var onceFlag = flag.Bool("once", false, "print one reading of each meter as JSON and exit, without serving metrics")
+var timeoutFlag = flag.Duration("timeout", time.Second*30, "time to wait for a reading with -once")
+var logFormatFlag = flag.String("log-format", "text", "log format: text or json")
+var logSyslogFlag = flag.Bool("log-syslog", false, "log to syslog instead of stderr, where available")
+var syslogAddressFlag = flag.String("syslog-address", "", "remote syslog daemon to log to with -log-syslog, e.g. udp://loghost:514 (default the local one)")
+var logLevelFlag = flag.String("log-level", "info", "minimum level of log messages: debug, info, warn or error; the readings are logged at debug")
+var readTimeoutFlag = flag.Duration("read-timeout", time.Minute, "time without a frame after which the device is reopened, 0 disables it")
+var openTimeoutFlag = flag.Duration("open-timeout", time.Second*30, "time to keep retrying to open the devices at startup")
+var userFlag = flag.String("user", "", "user to switch to after opening the devices")
+var groupFlag = flag.String("group", "", "group to switch to after opening the devices (default the primary group of -user)")
+var replayLoopFlag = flag.Bool("replay-loop", false, "replay the capture files given with -d in a loop")
+var recordFlag = flag.String("record", "", "append the raw frames read to this file, with several meters suffixed by their name")
+var recordMaxSizeFlag = flag.Int64("record-max-size", 0, "size in bytes at which the record file is truncated, or rotated with -record-max-files, 0 for no limit")
+var recordMaxFilesFlag = flag.Int("record-max-files", 0, "number of gzipped record files kept when rotating at -record-max-size, 0 truncates instead")
+var autoDecryptFlag = flag.Bool("auto-decrypt", false, "detect from the first frames whether the meter needs decryption, falling back to -skip-decryption")
+var debugFramesFlag = flag.Bool("debug-frames", false, "log every frame read from the device at debug level (needs -log-level debug)")
 var quietFlag = flag.Bool("q", false, "quiet mode (no periodic output)")
+var csvFlag = flag.String("csv", "", "file to append the readings to as CSV every report interval, - for stdout")
+var keyFlag = flag.String("key", "", "key in hex (8 bytes) the meter encrypts its frames with instead of a random one, for decrypting captures later")
+var keyFileFlag = flag.String("key-file", "", "file with the key in hex, see -key")
+var reportNumberFlag = flag.Int("report-number", 0, "number of the HID feature report the key is sent with, only some clones need another than 0")
 var skipDecryptionFlag = flag.Bool("skip-decryption", false, "skip value decryption. This is needed for some CO2 meter models.")
+var modelFlag = flag.String("model", "", "meter model to decode the frames of: "+strings.Join(co2meter.DecoderNames(), ", ")+" (default detected from the USB name)")
+var readIntervalFlag = flag.Duration("read-interval", readingInterval, "interval between readings from the device")
+var reportIntervalFlag = flag.Duration("report-interval", reportInterval, "interval between periodic outputs")
+var tempUnitFlag = flag.String("temp-unit", "c", "temperature unit: c (celsius), f (fahrenheit) or k (kelvin)")
+var emitAllTempUnitsFlag = flag.Bool("emit-all-temp-units", false, "export the temperature reading in celsius, fahrenheit and kelvin, not just in -temp-unit")
+var stalenessFlag = flag.Duration("staleness", time.Second*30, "time without a fresh reading after which the device is reported as down")
+var warmupFlag = flag.Duration("warmup", 0, "time after opening the device during which the sensor is reported as not ready")
+var warmupHideFlag = flag.Bool("warmup-hide", false, "do not export the readings of sensors that are not ready")
+var stuckThresholdFlag = flag.Duration("stuck-threshold", 0, "time of unchanged CO2 readings after which the sensor is reported as stuck, 0 disables it")
+var locationFlag = stringList("location", "location of the meter given by the -d at the same position")
+var mqttBrokerFlag = flag.String("mqtt-broker", "", "MQTT broker to publish readings to, e.g. tcp://localhost:1883")
+var mqttTopicPrefixFlag = flag.String("mqtt-topic-prefix", "co2meter", "prefix of the MQTT topics readings are published to")
+var mqttUsernameFlag = flag.String("mqtt-username", "", "MQTT username")
+var mqttPasswordFlag = flag.String("mqtt-password", "", "MQTT password")
+var mqttDiscoveryFlag = flag.Bool("mqtt-discovery", false, "publish Home Assistant MQTT discovery configs")
+var mqttNodeIDFlag = flag.String("mqtt-node-id", "", "node id used in Home Assistant discovery topics (default hostname)")
+var influxURLFlag = flag.String("influx-url", "", "InfluxDB server to write readings to, e.g. http://localhost:8086")
+var influxBucketFlag = flag.String("influx-bucket", "", "InfluxDB bucket")
+var influxOrgFlag = flag.String("influx-org", "", "InfluxDB organization")
+var influxTokenFlag = flag.String("influx-token", "", "InfluxDB API token")
+var graphiteAddressFlag = flag.String("graphite-address", "", "Graphite server to send readings to, e.g. localhost:2003, with the temperature in -temp-unit")
+var graphitePrefixFlag = flag.String("graphite-prefix", "co2meter", "prefix of the Graphite metric paths")
+var pushgatewayURLFlag = flag.String("pushgateway-url", "", "Pushgateway to push metrics to, e.g. http://localhost:9091")
+var pushJobFlag = flag.String("push-job", "co2meter", "job name of the metrics pushed to the Pushgateway")
+var remoteWriteURLFlag = flag.String("remote-write-url", "", "Prometheus remote write endpoint to send metrics to, e.g. https://prometheus.example.com/api/v1/write")
+var remoteWriteTokenFlag = flag.String("remote-write-token", "", "bearer token for the remote write endpoint")
+var remoteWriteJobFlag = flag.String("remote-write-job", "co2meter", "job label of the metrics sent with remote write")
+var alertThresholdFlag = flag.Int("alert-threshold", 0, "CO2 reading in PPM above which an alert is posted to -alert-webhook, 0 disables alerts")
+var alertWebhookFlag = flag.String("alert-webhook", "", "URL alerts are posted to as JSON")
+var alertHysteresisFlag = flag.Int("alert-hysteresis", 100, "PPM the CO2 reading has to fall below the threshold to clear an alert")
+var alertMinIntervalFlag = flag.Duration("alert-min-interval", time.Minute*5, "minimum time between alerts of a meter")
 
 func main() {
-	var key [8]byte
-
+	started := time.Now()
 	flag.Parse()
 
-	if *deviceFlag == "" {
+	if err := loadEnv(); err != nil {
+		log.Fatal("reading environment failed: ", err)
+	}
+	if *configFlag != "" {
+		if err := loadConfig(*configFlag, flag.Set); err != nil {
+			log.Fatal("loading config failed: ", err)
+		}
+	}
+
+	if err := setupLogging(*logFormatFlag, *logLevelFlag); err != nil {
+		log.Fatal(err)
+	}
+	if *logSyslogFlag {
+		if err := setupSyslog(*syslogAddressFlag); err != nil {
+			slog.Warn("Logging to syslog failed, logging to stderr instead", "err", err)
+		}
+	}
+
+	devices := *deviceFlag
+	if len(devices) == 0 && *autoFlag {
+		var err error
+		devices, err = co2meter.FindMeters()
+		if err != nil {
+			log.Fatal("detecting CO2 meters failed: ", err)
+		}
+		if len(devices) == 0 {
+			slog.Warn("No CO2 meter found, waiting for one to be plugged in")
+			devices = []string{autoDevice}
+		} else {
+			slog.Info("Found CO2 meters", "devices", strings.Join(devices, ", "))
+		}
+	}
+
+	if len(devices) == 0 {
 		log.Fatal("missing device path")
 	}
-	source, err := os.OpenFile(*deviceFlag, os.O_RDWR, 0600)
+	if len(*locationFlag) > len(devices) {
+		log.Fatal("more locations than devices given")
+	}
+	if (*tlsCertFlag == "") != (*tlsKeyFlag == "") {
+		log.Fatal("TLS needs both -tls-cert and -tls-key")
+	}
+	if *unixSocketFlag != "" && len(*listenFlag) > 0 {
+		log.Fatal("-unix-socket and -listen are mutually exclusive")
+	}
+	if *tlsClientCAFlag != "" && *tlsCertFlag == "" {
+		log.Fatal("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+	var auth *credentials
+	switch {
+	case *authHtpasswdFlag != "":
+		hashes, err := loadHtpasswd(*authHtpasswdFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth = &credentials{hashes: hashes}
+	case *authUserFlag != "" || *authPassFlag != "":
+		if *authUserFlag == "" || *authPassFlag == "" {
+			log.Fatal("HTTP basic auth needs both -auth-user and -auth-pass")
+		}
+		auth = &credentials{user: *authUserFlag, password: *authPassFlag}
+	}
+	if *readIntervalFlag <= 0 {
+		log.Fatal("read interval must be positive")
+	}
+	if *openTimeoutFlag < 0 {
+		log.Fatal("open timeout must not be negative")
+	}
+	if *keyFlag != "" && *keyFileFlag != "" {
+		log.Fatal("-key and -key-file are mutually exclusive")
+	}
+	if key := *keyFlag; key != "" || *keyFileFlag != "" {
+		if *keyFileFlag != "" {
+			data, err := os.ReadFile(*keyFileFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			key = string(data)
+		}
+		var err error
+		if fixedKey, err = parseKey(key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *reportNumberFlag < 0 || *reportNumberFlag > 255 {
+		log.Fatal("report number must be between 0 and 255")
+	}
+	if *timeoutFlag <= 0 {
+		log.Fatal("timeout must be positive")
+	}
+	if *recordMaxSizeFlag < 0 {
+		log.Fatal("record size limit must not be negative")
+	}
+	if *maxScrapesFlag < 0 {
+		log.Fatal("scrape limit must not be negative")
+	}
+	if *recordMaxFilesFlag < 0 {
+		log.Fatal("number of record files must not be negative")
+	}
+	if *recordMaxFilesFlag > 0 && *recordMaxSizeFlag == 0 {
+		log.Fatal("-record-max-files needs -record-max-size")
+	}
+	if *smoothWindowFlag < 0 {
+		log.Fatal("smoothing window must not be negative")
+	}
+	if *co2MinFlag >= *co2MaxFlag {
+		log.Fatal("-co2-min must be below -co2-max")
+	}
+	if *tempMinFlag >= *tempMaxFlag {
+		log.Fatal("-temp-min must be below -temp-max")
+	}
+	if *medianWindowFlag < 0 {
+		log.Fatal("median window must not be negative")
+	}
+	if *outlierThresholdFlag <= 0 {
+		log.Fatal("outlier threshold must be positive")
+	}
+	if *ewmaAlphaFlag < 0 || *ewmaAlphaFlag > 1 {
+		log.Fatal("EWMA alpha must be between 0 and 1")
+	}
+	if *windowFlag < 0 {
+		log.Fatal("window must not be negative")
+	}
+	if *modelFlag != "" {
+		if _, ok := co2meter.LookupDecoder(*modelFlag); !ok {
+			log.Fatal("unknown meter model: ", *modelFlag)
+		}
+		if *skipDecryptionFlag && *modelFlag != "plain" {
+			log.Fatal("-skip-decryption only goes with -model plain")
+		}
+	}
+	if *historySizeFlag < 0 {
+		log.Fatal("history size must not be negative")
+	}
+	if *historySizeFlag > 0 {
+		history = newRingHistory(*historySizeFlag)
+	}
+	initial, err := newSettings()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer source.Close()
+	liveSettings.Store(initial)
 
-	// Generate random key
-	rand.Read(key[:])
+	if *alertThresholdFlag > 0 && *alertWebhookFlag == "" {
+		log.Fatal("-alert-threshold needs -alert-webhook")
+	}
+	if *influxURLFlag != "" && *influxBucketFlag == "" {
+		log.Fatal("missing InfluxDB bucket")
+	}
+	unit, ok := temperatureUnits[*tempUnitFlag]
+	if !ok {
+		log.Fatal("unknown temperature unit: ", *tempUnitFlag)
+	}
+	for _, part := range []string{*metricNamespaceFlag, *metricSubsystemFlag, *metricPrefixFlag} {
+		if part != "" && !metricNameRegexp.MatchString(part) {
+			log.Fatal("invalid metric name part: ", part)
+		}
+	}
+	co2Buckets, err := parseBuckets(*co2BucketsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newCounters(co2Buckets)
+	if *legacyMetricNamesFlag {
+		slog.Warn(fmt.Sprintf("%s is deprecated and will be removed, use %s instead (or disable it with -legacy-metric-names=false)",
+			metricName("co2_ppms"), metricName("co2_ppm")))
+	}
 
-	hidSetReport(source, key[:])
+	sources := make([]*co2meter.Device, len(devices))
+	for i, device := range devices {
+		var location string
+		if i < len(*locationFlag) {
+			location = (*locationFlag)[i]
+		}
 
-	prometheus.MustRegister(temperatureGauge)
-	prometheus.MustRegister(co2Gauge)
+		// The reader opens the auto device once a meter is plugged in
+		var info co2meter.Info
+		if device != autoDevice {
+			source, err := openWithRetry(device, *openTimeoutFlag)
+			if err != nil {
+				log.Fatal(device, ": ", err)
+			}
+			sources[i] = source
 
-	go getReadings(source, key[:], *skipDecryptionFlag)
-	if !*quietFlag {
-		go logMetrics()
+			info, err = source.Info()
+			if err != nil && !errors.Is(err, co2meter.ErrInfoNotSupported) {
+				slog.Warn("Reading device info failed", "device", device, "err", err)
+			}
+			if err == nil && !info.IsMeter() && !*forceFlag {
+				log.Fatal(fmt.Sprintf("%s is not a CO2 meter: found USB device %04x:%04x %q, expected %04x:%04x (use -force to read from it anyway)",
+					device, info.Vendor, info.Product, info.Name, co2meter.VendorID, co2meter.ProductID))
+			}
+		}
+
+		state := newEnvState(device, location, info)
+		if model, ok := co2meter.DetectModel(info); ok {
+			slog.Info("Detected meter model", "device", device, "model", model.Name, "name", info.Name)
+			state.model = model
+		} else if info.Name != "" {
+			slog.Warn("Unknown meter model, -auto-decrypt may help if readings fail", "device", device, "name", info.Name)
+		}
+		states = append(states, state)
+	}
+
+	if *recordFlag != "" {
+		for _, state := range states {
+			rec, err := newRecorder(state.scoped(*recordFlag, "."), *recordMaxSizeFlag, *recordMaxFilesFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			state.recorder = rec
+			recorders = append(recorders, rec)
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	collector := newCo2Collector(unit)
+	registry.MustRegister(collector)
+	registry.MustRegister(invalidReadingsCounter)
+	registry.MustRegister(reconnectsCounter)
+	registry.MustRegister(readTimeoutsCounter)
+	registry.MustRegister(readErrorsCounter)
+	registry.MustRegister(stateChangesCounter)
+	registry.MustRegister(unknownFramesCounter)
+	registry.MustRegister(readingsCounter)
+	registry.MustRegister(outliersCounter)
+	registry.MustRegister(implausibleCounter)
+	registry.MustRegister(droppedReadingsCounter)
+	registry.MustRegister(scrapeDuration)
+	registry.MustRegister(scrapesCounter)
+	registry.MustRegister(goroutinePanicsCounter)
+	registry.MustRegister(readerRestartsCounter)
+	startTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: metricName("start_time_seconds"),
+		Help: "Unix time the exporter was started at.",
+	})
+	startTime.Set(float64(started.UnixNano()) / 1e9)
+	registry.MustRegister(startTime)
+	if co2Histogram != nil {
+		registry.MustRegister(co2Histogram)
+	}
+	if !*disableGoMetricsFlag {
+		registry.MustRegister(collectors.NewGoCollector())
+		registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+
+	// A mux of our own, as net/http/pprof registers itself on the default
+	// one.
+	mux := http.NewServeMux()
+	addresses := []string{net.JoinHostPort(*hostFlag, *portFlag)}
+	if len(*listenFlag) > 0 {
+		addresses = *listenFlag
+	}
+	var tlsConfig *tls.Config
+
+	scheme := "http"
+	if *tlsCertFlag != "" {
+		scheme = "https"
+	}
+	if *tlsClientCAFlag != "" {
+		pem, err := os.ReadFile(*tlsClientCAFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			log.Fatal("no certificates found in ", *tlsClientCAFlag)
+		}
+		tlsConfig = &tls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	if *tlsCertFlag != "" {
+		// Loaded here, as the key may not be readable any more once
+		// privileges are dropped.
+		cert, err := tls.LoadX509KeyPair(*tlsCertFlag, *tlsKeyFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	log.Printf("Listening on http://%s/metrics\n", net.JoinHostPort(*hostFlag, *portFlag))
+	// -once doesn't serve anything. With socket activation, systemd passes
+	// the sockets to serve on.
+	var listeners []net.Listener
+	activated := false
+	if !*onceFlag {
+		var err error
+		if listeners, err = activationListeners(); err != nil {
+			log.Fatal(err)
+		}
+		activated = len(listeners) > 0
+	}
+	if !*onceFlag && !activated {
+		if *unixSocketFlag != "" {
+			listener, err := listenUnix(*unixSocketFlag, *unixSocketModeFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			listeners = append(listeners, listener)
+		} else {
+			for _, address := range addresses {
+				listener, err := net.Listen("tcp", address)
+				if err != nil {
+					log.Fatal(err)
+				}
+				listeners = append(listeners, listener)
+			}
+		}
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
-	err = http.ListenAndServe(net.JoinHostPort(*hostFlag, *portFlag), nil)
-	log.Fatal(err)
+	if *userFlag != "" || *groupFlag != "" {
+		if err := dropPrivileges(*userFlag, *groupFlag); err != nil {
+			log.Fatal("dropping privileges failed: ", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *configFlag != "" {
+		go reloadOnHangup(ctx, *configFlag)
+	}
+
+	// The states are the first subscriber of the readings, and the sinks
+	// get the applied ones. All subscribe before the readers start, so they
+	// don't miss the first readings.
+	events, unsubscribe := broadcast.subscribe("state", stateBufferSize)
+	defer unsubscribe()
+	go supervise(ctx, "state", func() { applyReadings(ctx, events) })
+	var sinks []namedSink
+	if !*onceFlag {
+		sinks = enabledSinks(unit, registry, collector)
+	}
+
+	var readers sync.WaitGroup
+	for i, state := range states {
+		readers.Go(func() {
+			source := sources[i]
+			superviseReader(ctx, state, func() {
+				// getReadings closes the device when it panics, so a
+				// restart has to reopen it. The auto device is opened
+				// here in the first place.
+				if source == nil {
+					var err error
+					if source, err = reconnect(ctx, state); err != nil {
+						return
+					}
+				}
+				current := source
+				source = nil
+				getReadings(ctx, state, current, decoderOf(state), *readIntervalFlag)
+			})
+		})
+	}
+	if *onceFlag {
+		err := readOnce(ctx, *timeoutFlag, *readIntervalFlag)
+		stop()
+		readers.Wait()
+		for _, rec := range recorders {
+			rec.close()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(recorders) > 0 {
+		go supervise(ctx, "recorder", func() { flushRecorders(ctx) })
+	}
+
+	// Sinks may have to finish their work on shutdown
+	var outputs sync.WaitGroup
+	outputs.Go(func() { runSinks(ctx, sinks) })
+
+	switch {
+	case activated:
+		for _, listener := range listeners {
+			slog.Info(fmt.Sprintf("Listening on %s socket %s passed by systemd", scheme, listener.Addr()))
+		}
+	case *unixSocketFlag != "":
+		slog.Info(fmt.Sprintf("Listening on %s socket %s", scheme, *unixSocketFlag))
+	default:
+		for _, address := range addresses {
+			slog.Info(fmt.Sprintf("Listening on %s://%s/metrics", scheme, address))
+		}
+	}
+
+	metricsHandler := promhttp.InstrumentMetricHandler(registry,
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+			DisableCompression: *disableCompressionFlag,
+			EnableOpenMetrics:  true,
+		}))
+	metricsHandler = promhttp.InstrumentHandlerCounter(scrapesCounter,
+		promhttp.InstrumentHandlerDuration(scrapeDuration, metricsHandler))
+	if *maxScrapesFlag > 0 {
+		metricsHandler = rateLimit(*maxScrapesFlag, metricsHandler)
+	}
+	mux.Handle("/metrics", basicAuth(auth, metricsHandler))
+	mux.Handle("/readings", basicAuth(auth, http.HandlerFunc(readingsHandler)))
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.Handle("/stream", basicAuth(auth, http.HandlerFunc(streamHandler)))
+	if *dashboardFlag {
+		mux.Handle("GET /{$}", basicAuth(auth, http.HandlerFunc(dashboardHandler)))
+	}
+	if history != nil {
+		mux.Handle("/history", basicAuth(auth, http.HandlerFunc(historyHandler)))
+	}
+	if *pprofFlag {
+		mux.Handle("/debug/pprof/", basicAuth(auth, http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", basicAuth(auth, http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", basicAuth(auth, http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", basicAuth(auth, http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", basicAuth(auth, http.HandlerFunc(pprof.Trace)))
+	}
+	// The servers share the handlers and so the registry
+	handler := http.Handler(mux)
+	if *accessLogFlag {
+		handler = accessLog(handler)
+	}
+	servers := make([]*http.Server, len(listeners))
+	for i, listener := range listeners {
+		server := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+		servers[i] = server
+		go func() {
+			var err error
+			if *tlsCertFlag != "" {
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+	systemd.notify("STOPPING=1")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	close(streamsDone)
+	var shutdowns sync.WaitGroup
+	for _, server := range servers {
+		shutdowns.Go(func() {
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				slog.Error("HTTP server shutdown failed", "err", err)
+			}
+		})
+	}
+	shutdowns.Wait()
+
+	readers.Wait()
+	outputs.Wait()
+	for _, rec := range recorders {
+		rec.close()
+	}
 }
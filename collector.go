@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// co2Collector exports the readings of all meters as they are at scrape
+// time. Each reading is only exported once the meter reported it, so there
+// are no bogus zero values at startup and no humidity for meters without
+// humidity sensor.
+//
+// It is the sink of the readings for /metrics: on every applied reading it
+// takes the derived readings of the meter, which scrapes then export
+// without taking the lock of the state.
+type co2Collector struct {
+	unit    temperatureUnit
+	derived map[*envState]*atomic.Pointer[derivedReadings]
+
+	co2Desc         *prometheus.Desc
+	legacyCo2Desc   *prometheus.Desc
+	rawCo2Desc      *prometheus.Desc
+	smoothedCo2Desc *prometheus.Desc
+	ewmaCo2Desc     *prometheus.Desc
+	minCo2Desc      *prometheus.Desc
+	maxCo2Desc      *prometheus.Desc
+	co2RateDesc     *prometheus.Desc
+	co2MassDesc     *prometheus.Desc
+	temperatureDesc *prometheus.Desc
+	rawTempDesc     *prometheus.Desc
+	minTempDesc     *prometheus.Desc
+	maxTempDesc     *prometheus.Desc
+	tempRateDesc    *prometheus.Desc
+	humidityDesc    *prometheus.Desc
+	dewPointDesc    *prometheus.Desc
+	vpdDesc         *prometheus.Desc
+	absHumidityDesc *prometheus.Desc
+	heatIndexDesc   *prometheus.Desc
+	upDesc          *prometheus.Desc
+	stuckDesc       *prometheus.Desc
+	readyDesc       *prometheus.Desc
+	lastReadingDesc *prometheus.Desc
+	infoDesc        *prometheus.Desc
+	configInfoDesc  *prometheus.Desc
+
+	// otherTempDescs export the temperature in the other units with
+	// -emit-all-temp-units.
+	otherTempDescs []unitDesc
+}
+
+type unitDesc struct {
+	unit temperatureUnit
+	desc *prometheus.Desc
+}
+
+func newCo2Collector(unit temperatureUnit) *co2Collector {
+	c := &co2Collector{
+		unit:    unit,
+		derived: make(map[*envState]*atomic.Pointer[derivedReadings]),
+
+		co2Desc: prometheus.NewDesc(
+			metricName("co2_ppm"),
+			"CO2 reading in PPM.",
+			stateLabels, nil,
+		),
+		rawCo2Desc: prometheus.NewDesc(
+			metricName("co2_ppm_raw"),
+			"CO2 reading in PPM before calibration, pressure correction and outlier rejection.",
+			stateLabels, nil,
+		),
+		smoothedCo2Desc: prometheus.NewDesc(
+			metricName("co2_ppm_smoothed"),
+			"Mean of the latest CO2 readings in PPM.",
+			stateLabels, nil,
+		),
+		ewmaCo2Desc: prometheus.NewDesc(
+			metricName("co2_ppm_ewma"),
+			"Exponentially weighted moving average of the CO2 readings in PPM.",
+			stateLabels, nil,
+		),
+		minCo2Desc: prometheus.NewDesc(
+			metricName("co2_ppm_min"),
+			"Lowest CO2 reading in PPM within the window.",
+			stateLabels, nil,
+		),
+		maxCo2Desc: prometheus.NewDesc(
+			metricName("co2_ppm_max"),
+			"Highest CO2 reading in PPM within the window.",
+			stateLabels, nil,
+		),
+		co2RateDesc: prometheus.NewDesc(
+			metricName("co2_ppm_rate_per_minute"),
+			"Change of the CO2 reading in PPM per minute.",
+			stateLabels, nil,
+		),
+		co2MassDesc: prometheus.NewDesc(
+			metricName("co2_milligrams_per_cubic_meter"),
+			"CO2 mass concentration in milligrams per cubic meter, computed at the temperature reading and ambient pressure.",
+			stateLabels, nil,
+		),
+		temperatureDesc: prometheus.NewDesc(
+			metricName("temperature_"+unit.name),
+			"Temperature reading in "+unit.help+".",
+			stateLabels, nil,
+		),
+		rawTempDesc: prometheus.NewDesc(
+			metricName("temperature_"+unit.name+"_raw"),
+			"Temperature reading in "+unit.help+" before calibration.",
+			stateLabels, nil,
+		),
+		minTempDesc: prometheus.NewDesc(
+			metricName("temperature_"+unit.name+"_min"),
+			"Lowest temperature reading in "+unit.help+" within the window.",
+			stateLabels, nil,
+		),
+		maxTempDesc: prometheus.NewDesc(
+			metricName("temperature_"+unit.name+"_max"),
+			"Highest temperature reading in "+unit.help+" within the window.",
+			stateLabels, nil,
+		),
+		tempRateDesc: prometheus.NewDesc(
+			metricName("temperature_"+unit.name+"_rate_per_minute"),
+			"Change of the temperature reading in "+unit.help+" per minute.",
+			stateLabels, nil,
+		),
+		humidityDesc: prometheus.NewDesc(
+			metricName("humidity_percent"),
+			"Relative humidity reading in percent.",
+			stateLabels, nil,
+		),
+		dewPointDesc: prometheus.NewDesc(
+			metricName("dew_point_"+unit.name),
+			"Dew point in "+unit.help+", computed from temperature and relative humidity.",
+			stateLabels, nil,
+		),
+		vpdDesc: prometheus.NewDesc(
+			metricName("vpd_kilopascals"),
+			"Vapor pressure deficit in kilopascals, computed from temperature and relative humidity.",
+			stateLabels, nil,
+		),
+		absHumidityDesc: prometheus.NewDesc(
+			metricName("absolute_humidity_grams_per_cubic_meter"),
+			"Absolute humidity in grams per cubic meter, computed from temperature and relative humidity.",
+			stateLabels, nil,
+		),
+		heatIndexDesc: prometheus.NewDesc(
+			metricName("heat_index_"+unit.name),
+			"Apparent temperature in "+unit.help+" after the NWS heat index, which is the temperature below 80 degree fahrenheit.",
+			stateLabels, nil,
+		),
+		upDesc: prometheus.NewDesc(
+			metricName("up"),
+			"Whether the device delivered a fresh reading within the staleness window.",
+			stateLabels, nil,
+		),
+		stuckDesc: prometheus.NewDesc(
+			metricName("sensor_stuck"),
+			"Whether the sensor repeated the same CO2 reading for longer than the stuck threshold.",
+			stateLabels, nil,
+		),
+		readyDesc: prometheus.NewDesc(
+			metricName("sensor_ready"),
+			"Whether the sensor delivered a reading after the warmup following the opening of the device.",
+			stateLabels, nil,
+		),
+		lastReadingDesc: prometheus.NewDesc(
+			metricName("last_reading_timestamp_seconds"),
+			"Unix time of the last valid reading.",
+			stateLabels, nil,
+		),
+		infoDesc: prometheus.NewDesc(
+			metricName("info"),
+			"Exporter build and device information.",
+			append([]string{"version", "commit", "date", "go_version", "vendor", "product", "model"}, stateLabels...),
+			nil,
+		),
+		configInfoDesc: prometheus.NewDesc(
+			metricName("config_info"),
+			"Settings in effect, as labels.",
+			[]string{"skip_decryption", "auto_decrypt", "model", "temp_unit", "read_interval", "read_timeout",
+				"report_interval", "staleness", "warmup", "calibrated"},
+			nil,
+		),
+	}
+
+	if *emitAllTempUnitsFlag {
+		for _, key := range slices.Sorted(maps.Keys(temperatureUnits)) {
+			other := temperatureUnits[key]
+			if other.name == unit.name {
+				continue
+			}
+			c.otherTempDescs = append(c.otherTempDescs, unitDesc{other, prometheus.NewDesc(
+				metricName("temperature_"+other.name),
+				"Temperature reading in "+other.help+".",
+				stateLabels, nil,
+			)})
+		}
+	}
+
+	if *legacyMetricNamesFlag {
+		c.legacyCo2Desc = prometheus.NewDesc(
+			metricName("co2_ppms"),
+			"CO2 reading in PPM. Deprecated, use "+metricName("co2_ppm")+" instead.",
+			stateLabels, nil,
+		)
+	}
+
+	for _, state := range states {
+		c.derived[state] = new(atomic.Pointer[derivedReadings])
+	}
+
+	return c
+}
+
+func (c *co2Collector) Publish(event readingEvent) {
+	derived := event.state.derived()
+	c.derived[event.state].Store(&derived)
+}
+
+// Flush does nothing, the readings are exported on scrape.
+func (c *co2Collector) Flush(ctx context.Context) {}
+
+func (c *co2Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.co2Desc
+	if c.legacyCo2Desc != nil {
+		ch <- c.legacyCo2Desc
+	}
+	ch <- c.rawCo2Desc
+	ch <- c.smoothedCo2Desc
+	ch <- c.ewmaCo2Desc
+	ch <- c.minCo2Desc
+	ch <- c.maxCo2Desc
+	ch <- c.co2RateDesc
+	ch <- c.co2MassDesc
+	ch <- c.temperatureDesc
+	for _, other := range c.otherTempDescs {
+		ch <- other.desc
+	}
+	ch <- c.rawTempDesc
+	ch <- c.minTempDesc
+	ch <- c.maxTempDesc
+	ch <- c.tempRateDesc
+	ch <- c.humidityDesc
+	ch <- c.dewPointDesc
+	ch <- c.vpdDesc
+	ch <- c.absHumidityDesc
+	ch <- c.heatIndexDesc
+	ch <- c.upDesc
+	ch <- c.stuckDesc
+	ch <- c.readyDesc
+	ch <- c.lastReadingDesc
+	ch <- c.infoDesc
+	ch <- c.configInfoDesc
+}
+
+func (c *co2Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range states {
+		labels := s.labelValues()
+		// With -reading-timestamps, the readings carry the time they were
+		// taken rather than that of the scrape.
+		reading := func(m prometheus.Metric) {
+			if *readingTimestampsFlag {
+				m = prometheus.NewMetricWithTimestamp(s.LastReading(), m)
+			}
+			ch <- m
+		}
+
+		// With -warmup-hide, the readings of a sensor are only exported
+		// once it is ready.
+		hidden := *warmupHideFlag && !s.IsReady()
+		hasCo2 := s.hasCo2.Load() && !hidden
+		hasTemperature := s.hasTemperature.Load() && !hidden
+		hasHumidity := s.hasHumidity.Load() && !hidden
+
+		var derived derivedReadings
+		if d := c.derived[s].Load(); d != nil {
+			derived = *d
+		}
+		if hasCo2 {
+			reading(prometheus.MustNewConstMetric(c.co2Desc, prometheus.GaugeValue, s.Co2(), labels...))
+			if c.legacyCo2Desc != nil {
+				reading(prometheus.MustNewConstMetric(c.legacyCo2Desc, prometheus.GaugeValue, s.Co2(), labels...))
+			}
+			if current().stuckThreshold > 0 {
+				ch <- prometheus.MustNewConstMetric(c.stuckDesc, prometheus.GaugeValue, s.Stuck(), labels...)
+			}
+			if !current().co2Calibration.identity() || s.medianWindow != nil {
+				reading(prometheus.MustNewConstMetric(c.rawCo2Desc, prometheus.GaugeValue, s.RawCo2(), labels...))
+			}
+			if s.co2Window != nil {
+				reading(prometheus.MustNewConstMetric(c.smoothedCo2Desc, prometheus.GaugeValue, derived.smoothedCo2, labels...))
+			}
+			if *ewmaAlphaFlag > 0 {
+				reading(prometheus.MustNewConstMetric(c.ewmaCo2Desc, prometheus.GaugeValue, derived.ewmaCo2, labels...))
+			}
+			temperature := float64(standardTemperature)
+			if hasTemperature {
+				temperature = s.Temperature()
+			}
+			reading(prometheus.MustNewConstMetric(c.co2MassDesc, prometheus.GaugeValue, co2MassConcentration(s.Co2(), temperature, current().ambientPressure), labels...))
+			if derived.hasCo2Rate {
+				reading(prometheus.MustNewConstMetric(c.co2RateDesc, prometheus.GaugeValue, derived.co2Rate, labels...))
+			}
+			if derived.hasCo2Range {
+				reading(prometheus.MustNewConstMetric(c.minCo2Desc, prometheus.GaugeValue, derived.co2Min, labels...))
+				reading(prometheus.MustNewConstMetric(c.maxCo2Desc, prometheus.GaugeValue, derived.co2Max, labels...))
+			}
+		}
+		if hasTemperature {
+			reading(prometheus.MustNewConstMetric(c.temperatureDesc, prometheus.GaugeValue, c.unit.fromCelsius(s.Temperature()), labels...))
+			for _, other := range c.otherTempDescs {
+				reading(prometheus.MustNewConstMetric(other.desc, prometheus.GaugeValue, other.unit.fromCelsius(s.Temperature()), labels...))
+			}
+			if !current().temperatureCalibration.identity() {
+				reading(prometheus.MustNewConstMetric(c.rawTempDesc, prometheus.GaugeValue, c.unit.fromCelsius(s.RawTemperature()), labels...))
+			}
+			if derived.hasTemperatureRate {
+				reading(prometheus.MustNewConstMetric(c.tempRateDesc, prometheus.GaugeValue, c.unit.fromCelsiusDelta(derived.temperatureRate), labels...))
+			}
+			if derived.hasTemperatureRange {
+				reading(prometheus.MustNewConstMetric(c.minTempDesc, prometheus.GaugeValue, c.unit.fromCelsius(derived.temperatureMin), labels...))
+				reading(prometheus.MustNewConstMetric(c.maxTempDesc, prometheus.GaugeValue, c.unit.fromCelsius(derived.temperatureMax), labels...))
+			}
+		}
+		if hasHumidity {
+			reading(prometheus.MustNewConstMetric(c.humidityDesc, prometheus.GaugeValue, s.Humidity(), labels...))
+		}
+		// The derived metrics need both readings, and a humidity of zero
+		// has no dew point.
+		if hasTemperature && hasHumidity && s.Humidity() > 0 {
+			temperature, humidity := s.Temperature(), s.Humidity()
+			reading(prometheus.MustNewConstMetric(c.dewPointDesc, prometheus.GaugeValue, c.unit.fromCelsius(dewPoint(temperature, humidity)), labels...))
+			reading(prometheus.MustNewConstMetric(c.vpdDesc, prometheus.GaugeValue, vpd(temperature, humidity), labels...))
+			reading(prometheus.MustNewConstMetric(c.absHumidityDesc, prometheus.GaugeValue, absoluteHumidity(temperature, humidity), labels...))
+			reading(prometheus.MustNewConstMetric(c.heatIndexDesc, prometheus.GaugeValue, c.unit.fromCelsius(heatIndex(temperature, humidity)), labels...))
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, s.Up(), labels...)
+		if *warmupFlag > 0 {
+			ch <- prometheus.MustNewConstMetric(c.readyDesc, prometheus.GaugeValue, s.Ready(), labels...)
+		}
+		// Before the first reading this reports the zero time, which is
+		// far enough in the past to trip any staleness alert.
+		ch <- prometheus.MustNewConstMetric(c.lastReadingDesc, prometheus.GaugeValue, float64(s.LastReading().Unix()), labels...)
+
+		ch <- prometheus.MustNewConstMetric(c.infoDesc, prometheus.GaugeValue, 1,
+			append([]string{version, commit, date, runtime.Version(), hexID(s.info.Vendor), hexID(s.info.Product), s.model.Name}, labels...)...)
+	}
+
+	settings := current()
+	model := *modelFlag
+	if model == "" {
+		model = "auto"
+	}
+	calibrated := !settings.co2Calibration.identity() || !settings.temperatureCalibration.identity()
+	ch <- prometheus.MustNewConstMetric(c.configInfoDesc, prometheus.GaugeValue, 1,
+		strconv.FormatBool(*skipDecryptionFlag), strconv.FormatBool(*autoDecryptFlag), model, c.unit.name,
+		readIntervalFlag.String(), readTimeoutFlag.String(), settings.reportInterval.String(),
+		settings.staleness.String(), warmupFlag.String(), strconv.FormatBool(calibrated))
+}
+
+// hexID formats a USB ID the way lsusb does, or leaves it empty if unknown.
+func hexID(id uint16) string {
+	if id == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%04x", id)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rnurgaliyev/co2meter_exporter/co2meter"
+)
+
+// BenchmarkCollect scrapes a meter one goroutine at a time and from
+// parallel ones, so comparing the two shows how much concurrent scrapes
+// contend. Collect takes no lock, the derived readings are those the
+// collector took on the last applied reading.
+func BenchmarkCollect(b *testing.B) {
+	newCounters(nil)
+	settings, err := newSettings()
+	if err != nil {
+		b.Fatal(err)
+	}
+	liveSettings.Store(settings)
+
+	state := newEnvState("/dev/hidraw0", "office", co2meter.Info{Serial: "1.40"})
+	state.setCo2(800, 800)
+	state.setTemperature(4722, kelvin16ToCelsius(4722))
+	state.setHumidity(4500)
+	states = []*envState{state}
+	defer func() { states = nil }()
+
+	collector := newCo2Collector(temperatureUnits["c"])
+	collector.Publish(readingEvent{state, co2meter.Reading{Code: 0x50, Value: 800, Kind: co2meter.CO2}})
+	collect := func(ch chan prometheus.Metric) {
+		collector.Collect(ch)
+		for len(ch) > 0 {
+			<-ch
+		}
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		ch := make(chan prometheus.Metric, 256)
+		for b.Loop() {
+			collect(ch)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			ch := make(chan prometheus.Metric, 256)
+			for pb.Next() {
+				collect(ch)
+			}
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configAliases maps the readable config file keys of the single letter
+// flags to them.
+var configAliases = map[string]string{
+	"device": "d",
+	"host":   "h",
+	"port":   "p",
+	"quiet":  "q",
+}
+
+// envPrefix is prepended to the environment variables flags are read from.
+const envPrefix = "CO2METER_"
+
+// envName returns the environment variable of a flag, e.g. CO2METER_CO2_OFFSET
+// for -co2-offset and CO2METER_DEVICE for -d.
+func envName(name string) string {
+	for key, alias := range configAliases {
+		if alias == name {
+			name = key
+		}
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnv sets the flags not given on the command line from their
+// environment variables.
+func loadEnv() error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+		if e := flag.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s: %w", envName(f.Name), e)
+		}
+	})
+	return err
+}
+
+// pinnedFlags are the flags given on the command line or set from the
+// environment, which the config file does not override. They are recorded
+// when the config file is first loaded.
+var pinnedFlags map[string]bool
+
+// loadConfig calls set for the values of the flags in the YAML file at
+// path, which is flag.Set when loading it at startup. Its keys are the flag
+// names without the dash, lists are accepted for flags that may be given
+// several times. Flags given on the command line or set from the
+// environment take precedence.
+func loadConfig(path string, set func(name, value string) error) error {
+	if pinnedFlags == nil {
+		pinnedFlags = map[string]bool{}
+		flag.Visit(func(f *flag.Flag) {
+			pinnedFlags[f.Name] = true
+		})
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]yaml.Node
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&values); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for key, node := range values {
+		name := key
+		if alias, ok := configAliases[key]; ok {
+			name = alias
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown key %q", path, node.Line, key)
+		}
+		if pinnedFlags[name] {
+			continue
+		}
+
+		items := []*yaml.Node{&node}
+		if node.Kind == yaml.SequenceNode {
+			items = node.Content
+		}
+		for _, item := range items {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("%s:%d: %s: expected a value", path, item.Line, key)
+			}
+			value := item.Value
+			if isBoolFlag(name) {
+				var b bool
+				if err := item.Decode(&b); err != nil {
+					return fmt.Errorf("%s:%d: %s: expected a boolean", path, item.Line, key)
+				}
+				value = strconv.FormatBool(b)
+			}
+			if err := set(name, value); err != nil {
+				return fmt.Errorf("%s:%d: %s: %w", path, item.Line, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isBoolFlag reports whether the flag takes no value on the command line.
+func isBoolFlag(name string) bool {
+	b, ok := flag.Lookup(name).Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// csvSink writes the readings as CSV lines to stdout or a file, with a
+// header line at the start of the file. The device column is only there
+// with several meters, and the humidity column is empty for meters without
+// humidity.
+type csvSink struct {
+	unit    temperatureUnit
+	out     io.Writer
+	writer  *csv.Writer
+	updated updatedMeters
+}
+
+// newCSVSink opens path for appending, or stdout for "-".
+func newCSVSink(path string, unit temperatureUnit) (*csvSink, error) {
+	c := &csvSink{unit: unit, out: os.Stdout}
+	header := true
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if stat, err := file.Stat(); err == nil && stat.Size() > 0 {
+			header = false
+		}
+		c.out = file
+	}
+	c.writer = csv.NewWriter(c.out)
+
+	if header {
+		columns := []string{"timestamp", "co2", "temperature", "humidity"}
+		if len(states) > 1 {
+			columns = append([]string{"timestamp", "device"}, columns[1:]...)
+		}
+		c.writer.Write(columns)
+		c.writer.Flush()
+	}
+
+	return c, c.writer.Error()
+}
+
+func (c *csvSink) Publish(event readingEvent) {
+	c.updated.add(event.state)
+}
+
+func (c *csvSink) write(state *envState, now time.Time) {
+	var humidity string
+	if state.hasHumidity.Load() {
+		humidity = strconv.FormatFloat(state.Humidity(), 'f', -1, 64)
+	}
+	record := []string{
+		now.Format(time.RFC3339),
+		strconv.FormatFloat(state.Co2(), 'f', -1, 64),
+		strconv.FormatFloat(c.unit.fromCelsius(state.Temperature()), 'f', 2, 64),
+		humidity,
+	}
+	if len(states) > 1 {
+		record = append([]string{record[0], state.name()}, record[1:]...)
+	}
+	c.writer.Write(record)
+}
+
+// Flush writes a line for every meter with readings since the last flush,
+// and writes them out right away for tail -f.
+func (c *csvSink) Flush(ctx context.Context) {
+	now := time.Now()
+	for _, state := range c.updated.take() {
+		c.write(state, now)
+	}
+	c.writer.Flush()
+	if err := c.writer.Error(); err != nil {
+		slog.Error("Writing CSV failed", "err", err)
+	}
+}
+
+func (c *csvSink) Close() error {
+	if closer, ok := c.out.(io.Closer); ok && c.out != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
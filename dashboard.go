@@ -0,0 +1,15 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+//go:embed dashboard.html
+var dashboardFS embed.FS
+
+// dashboardHandler serves a page showing the readings of /stream.
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFileFS(w, r, dashboardFS, "dashboard.html")
+}
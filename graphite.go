@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	graphiteTimeout    = time.Second * 5
+	graphiteMaxPending = 1000
+)
+
+// graphiteTemperaturePath returns the name of the temperature in the metric
+// paths. Units other than celsius get a suffix like the Prometheus metric,
+// so changing -temp-unit does not mix units in one series.
+func graphiteTemperaturePath(unit temperatureUnit) string {
+	if unit.symbol == "C" {
+		return "temperature"
+	}
+	return "temperature_" + unit.name
+}
+
+func graphiteLines(state *envState, unit temperatureUnit, now time.Time) []string {
+	prefix := state.scoped(*graphitePrefixFlag, ".")
+
+	lines := []string{
+		fmt.Sprintf("%s.co2 %.0f %d\n", prefix, state.Co2(), now.Unix()),
+		fmt.Sprintf("%s.%s %.2f %d\n", prefix, graphiteTemperaturePath(unit), unit.fromCelsius(state.Temperature()), now.Unix()),
+	}
+	if state.hasHumidity.Load() {
+		lines = append(lines, fmt.Sprintf("%s.humidity %.2f %d\n", prefix, state.Humidity(), now.Unix()))
+	}
+
+	return lines
+}
+
+// graphiteSink sends the current readings over the Graphite plaintext
+// protocol. While the server is unreachable lines are buffered, dropping the
+// newest ones once the buffer is full.
+type graphiteSink struct {
+	unit    temperatureUnit
+	conn    net.Conn
+	pending []string
+	updated updatedMeters
+}
+
+func (g *graphiteSink) Publish(event readingEvent) {
+	g.updated.add(event.state)
+}
+
+func (g *graphiteSink) Flush(ctx context.Context) {
+	now := time.Now()
+	for _, state := range g.updated.take() {
+		lines := graphiteLines(state, g.unit, now)
+		if len(g.pending)+len(lines) <= graphiteMaxPending {
+			g.pending = append(g.pending, lines...)
+		}
+	}
+	if len(g.pending) == 0 {
+		return
+	}
+
+	if g.conn == nil {
+		dialer := net.Dialer{Timeout: graphiteTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", *graphiteAddressFlag)
+		if err != nil {
+			slog.Error("Connecting to Graphite failed", "err", err)
+			return
+		}
+		g.conn = conn
+	}
+
+	g.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	if _, err := io.WriteString(g.conn, strings.Join(g.pending, "")); err != nil {
+		slog.Error("Writing to Graphite failed", "err", err)
+		g.conn.Close()
+		g.conn = nil
+		return
+	}
+
+	g.pending = g.pending[:0]
+}
+
+func (g *graphiteSink) Close() error {
+	if g.conn == nil {
+		return nil
+	}
+	return g.conn.Close()
+}
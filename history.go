@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type historyEntry struct {
+	Device      string    `json:"device"`
+	Co2         float64   `json:"co2_ppm"`
+	Temperature float64   `json:"temperature_celsius"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// ringHistory keeps the last readings in a fixed size ring buffer, which
+// overwrites the oldest entry once it is full.
+type ringHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+// history holds the last -history-size readings of all meters, it is nil
+// if disabled.
+var history *ringHistory
+
+func newRingHistory(size int) *ringHistory {
+	return &ringHistory{entries: make([]historyEntry, size)}
+}
+
+func (h *ringHistory) add(entry historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// snapshot returns the entries from the oldest to the newest.
+func (h *ringHistory) snapshot() []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.full {
+		return append([]historyEntry{}, h.entries[:h.next]...)
+	}
+	return append(append([]historyEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// recordHistory adds the current readings of state to the history, if enabled.
+func recordHistory(state *envState) {
+	if history == nil {
+		return
+	}
+	history.add(historyEntry{
+		Device:      state.device,
+		Co2:         state.Co2(),
+		Temperature: state.Temperature(),
+		Timestamp:   state.LastReading(),
+	})
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(history.snapshot())
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type readings struct {
+	Device      string    `json:"device"`
+	Location    string    `json:"location,omitempty"`
+	Co2         float64   `json:"co2_ppm"`
+	Temperature float64   `json:"temperature_celsius"`
+	Humidity    *float64  `json:"humidity_percent,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	Up          bool      `json:"up"`
+}
+
+func currentReadings(state *envState) readings {
+	current := readings{
+		Device:      state.device,
+		Location:    state.location,
+		Co2:         state.Co2(),
+		Temperature: state.Temperature(),
+		Timestamp:   state.LastReading(),
+		Up:          state.IsUp(),
+	}
+	if state.hasHumidity.Load() {
+		humidity := state.Humidity()
+		current.Humidity = &humidity
+	}
+
+	return current
+}
+
+// allReadings returns the readings of a single meter as object, and those
+// of several meters as array.
+func allReadings() any {
+	if len(states) == 1 {
+		return currentReadings(states[0])
+	}
+
+	all := make([]readings, len(states))
+	for i, state := range states {
+		all[i] = currentReadings(state)
+	}
+	return all
+}
+
+func readingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(allReadings())
+}
+
+type health struct {
+	Status string `json:"status"`
+	// Age of the oldest last reading of all meters
+	LastReadingAge float64 `json:"last_reading_age_seconds"`
+}
+
+// healthHandler reports the exporter as healthy while all meters are open
+// and delivered a reading within the staleness window. It is not behind
+// basic auth, for the sake of load balancers and orchestrators.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	response := health{Status: "ok"}
+	for _, state := range states {
+		if !state.connected.Load() || !state.IsUp() {
+			response.Status = "unhealthy"
+		}
+		response.LastReadingAge = max(response.LastReadingAge, time.Since(state.LastReading()).Seconds())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// streamBufferSize is the number of readings buffered for every client of
+// /stream. As each event has the latest readings, dropping older ones is
+// harmless.
+const streamBufferSize = 4
+
+// streams counts the clients of /stream, and streamsDone is closed on
+// shutdown to end their streams.
+var (
+	streams     atomic.Int32
+	streamsDone = make(chan struct{})
+)
+
+// streamHandler sends the readings as server-sent events in the format of
+// /readings, once at the start and then whenever a reading was applied.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if int(streams.Add(1)) > *streamMaxClientsFlag {
+		streams.Add(-1)
+		http.Error(w, "too many streams", http.StatusServiceUnavailable)
+		return
+	}
+	defer streams.Add(-1)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+
+	events, unsubscribe := applied.subscribe("stream", streamBufferSize)
+	defer unsubscribe()
+
+	for {
+		data, err := json.Marshal(allReadings())
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-streamsDone:
+			return
+		case <-events:
+		}
+	}
+}
+
+// credentials checks HTTP basic auth logins, either against a single user
+// and password or against the bcrypt hashes of an htpasswd file.
+type credentials struct {
+	user     string
+	password string
+	hashes   map[string][]byte
+}
+
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported", path, line)
+		}
+		hashes[user] = []byte(hash)
+	}
+
+	return hashes, scanner.Err()
+}
+
+func (c *credentials) valid(user string, password string) bool {
+	if c.hashes != nil {
+		hash, ok := c.hashes[user]
+		return ok && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}
+
+	// Compare digests so the comparison takes the same time regardless of
+	// where and whether the lengths differ
+	userSum := sha256.Sum256([]byte(user))
+	wantUserSum := sha256.Sum256([]byte(c.user))
+	passwordSum := sha256.Sum256([]byte(password))
+	wantPasswordSum := sha256.Sum256([]byte(c.password))
+
+	return subtle.ConstantTimeCompare(userSum[:], wantUserSum[:])&
+		subtle.ConstantTimeCompare(passwordSum[:], wantPasswordSum[:]) == 1
+}
+
+// basicAuth requires valid credentials for handler. Without credentials
+// configured it returns handler unchanged.
+func basicAuth(c *credentials, handler http.Handler) http.Handler {
+	if c == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || !c.valid(user, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="co2meter_exporter", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status of a response for accessLog.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush keeps /stream working.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// accessLog logs every request to handler once it is done.
+func accessLog(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		slog.Info("Request", "method", r.Method, "path", r.URL.Path, "status", recorder.status,
+			"duration", time.Since(start), "remote", r.RemoteAddr)
+	})
+}
+
+// tokenBucket allows rate requests per second on average, and bursts of
+// up to burst requests.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := max(math.Ceil(rate), 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow takes a token if there is one.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimit answers requests beyond perSecond with 429 Too Many Requests
+// instead of passing them to handler.
+func rateLimit(perSecond float64, handler http.Handler) http.Handler {
+	bucket := newTokenBucket(perSecond)
+	retryAfter := strconv.Itoa(int(math.Ceil(1 / perSecond)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bucket.allow(time.Now()) {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "too many scrapes", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import "math"
+
+// Magnus formula coefficients over water, valid from -45 to 60 degree
+// celsius.
+const (
+	magnusA = 17.62
+	magnusB = 243.12
+	magnusC = 0.6112 // kPa
+)
+
+const gasConstant = 8.314462 // J/(mol K)
+
+// saturationVaporPressure returns the saturation vapor pressure in kPa at
+// a temperature in degree celsius.
+func saturationVaporPressure(tempC float64) float64 {
+	return magnusC * math.Exp(magnusA*tempC/(magnusB+tempC))
+}
+
+// dewPoint returns the dew point in degree celsius for a temperature in
+// degree celsius and a relative humidity in percent.
+func dewPoint(tempC, rh float64) float64 {
+	gamma := math.Log(rh/100) + magnusA*tempC/(magnusB+tempC)
+	return magnusB * gamma / (magnusA - gamma)
+}
+
+// vpd returns the vapor pressure deficit in kPa for a temperature in degree
+// celsius and a relative humidity in percent.
+func vpd(tempC, rh float64) float64 {
+	return saturationVaporPressure(tempC) * (1 - rh/100)
+}
+
+// absoluteHumidity returns the absolute humidity in g/m³ for a temperature
+// in degree celsius and a relative humidity in percent.
+func absoluteHumidity(tempC, rh float64) float64 {
+	const waterMolarMass = 18.01528 // g/mol
+
+	vaporPressure := saturationVaporPressure(tempC) * rh / 100 * 1000 // Pa
+	return vaporPressure * waterMolarMass / (gasConstant * (tempC + 273.15))
+}
+
+// heatIndex returns the apparent temperature in degree celsius for a
+// temperature in degree celsius and a relative humidity in percent, using
+// the Rothfusz regression of the NWS with its adjustments. Below 80 degree
+// fahrenheit, where the regression does not hold, it is the temperature.
+func heatIndex(tempC, rh float64) float64 {
+	t := tempC*9/5 + 32
+	if t < 80 {
+		return tempC
+	}
+
+	hi := -42.379 + 2.04901523*t + 10.14333127*rh -
+		0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+		0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+	switch {
+	case rh < 13 && t <= 112:
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	case rh > 85 && t <= 87:
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+
+	return (hi - 32) * 5 / 9
+}
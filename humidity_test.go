@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// humidityCase is a reference value of a function of the temperature in
+// degree celsius and the relative humidity in percent.
+type humidityCase struct {
+	tempC, rh float64
+	want      float64
+	tolerance float64
+}
+
+func testHumidity(t *testing.T, name string, f func(tempC, rh float64) float64, tests []humidityCase) {
+	t.Helper()
+	for _, tt := range tests {
+		if got := f(tt.tempC, tt.rh); math.Abs(got-tt.want) > tt.tolerance {
+			t.Errorf("%s(%v, %v) = %v, want %v", name, tt.tempC, tt.rh, got, tt.want)
+		}
+	}
+}
+
+func TestDewPoint(t *testing.T) {
+	testHumidity(t, "dewPoint", dewPoint, []humidityCase{
+		{25, 50, 13.85, 0.01},
+		{25, 100, 25, 1e-9},
+		{0, 80, -3.0, 0.05},
+	})
+}
+
+func TestVPD(t *testing.T) {
+	testHumidity(t, "vpd", vpd, []humidityCase{
+		{25, 50, 1.58, 0.005},
+		{25, 100, 0, 1e-9},
+		{20, 60, 0.935, 0.005},
+	})
+}
+
+func TestAbsoluteHumidity(t *testing.T) {
+	testHumidity(t, "absoluteHumidity", absoluteHumidity, []humidityCase{
+		{25, 50, 11.48, 0.01},
+		{20, 100, 17.3, 0.1},
+		{25, 0, 0, 1e-9},
+	})
+}
+
+func TestHeatIndex(t *testing.T) {
+	// The reference values of the NWS are in degree fahrenheit
+	heatIndexF := func(tempF, rh float64) float64 {
+		return heatIndex((tempF-32)*5/9, rh)*9/5 + 32
+	}
+	testHumidity(t, "heatIndex", heatIndexF, []humidityCase{
+		{90, 60, 99.7, 0.1},
+		{79, 90, 79, 1e-9},
+		{70, 50, 70, 1e-9},
+	})
+}
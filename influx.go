@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	influxMaxPending = 1000
+	influxMaxBackoff = time.Minute * 5
+)
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// influxLine formats the current readings of a meter in InfluxDB line
+// protocol.
+func influxLine(state *envState, now time.Time) string {
+	fields := fmt.Sprintf("co2=%di,temperature=%g", int64(state.Co2()), state.Temperature())
+	if state.hasHumidity.Load() {
+		fields += fmt.Sprintf(",humidity=%g", state.Humidity())
+	}
+
+	return fmt.Sprintf("co2meter%s %s %d\n", influxTags(state), fields, now.UnixNano())
+}
+
+func influxTags(state *envState) string {
+	hostname, _ := os.Hostname()
+
+	tags := ""
+	if len(states) > 1 {
+		tags += ",device=" + influxTagEscaper.Replace(state.device)
+	}
+	tags += ",host=" + influxTagEscaper.Replace(hostname)
+	if state.location != "" {
+		tags += ",location=" + influxTagEscaper.Replace(state.location)
+	}
+
+	return tags
+}
+
+// errRetryable marks write failures worth retrying.
+type errRetryable struct {
+	error
+}
+
+func writeInflux(ctx context.Context, batch []byte) error {
+	query := url.Values{}
+	query.Set("org", *influxOrgFlag)
+	query.Set("bucket", *influxBucketFlag)
+	query.Set("precision", "ns")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(*influxURLFlag, "/")+"/api/v2/write?"+query.Encode(), bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if *influxTokenFlag != "" {
+		req.Header.Set("Authorization", "Token "+*influxTokenFlag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errRetryable{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("InfluxDB write failed: %s: %s", resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return errRetryable{err}
+	}
+	return err
+}
+
+// influxSink writes the current readings to InfluxDB. Points that could not
+// be written are kept and written together with the next ones, backing off
+// exponentially while the server fails.
+type influxSink struct {
+	interval    time.Duration
+	pending     []string
+	backoff     time.Duration
+	nextAttempt time.Time
+	updated     updatedMeters
+}
+
+func newInfluxSink(interval time.Duration) *influxSink {
+	return &influxSink{interval: interval}
+}
+
+func (i *influxSink) Publish(event readingEvent) {
+	i.updated.add(event.state)
+}
+
+func (i *influxSink) Flush(ctx context.Context) {
+	now := time.Now()
+	for _, state := range i.updated.take() {
+		i.pending = append(i.pending, influxLine(state, now))
+	}
+	if len(i.pending) == 0 {
+		return
+	}
+	if len(i.pending) > influxMaxPending {
+		i.pending = i.pending[len(i.pending)-influxMaxPending:]
+	}
+
+	if now.Before(i.nextAttempt) {
+		return
+	}
+
+	err := writeInflux(ctx, []byte(strings.Join(i.pending, "")))
+	if retryable, ok := err.(errRetryable); ok {
+		i.backoff = min(max(i.backoff*2, i.interval), influxMaxBackoff)
+		i.nextAttempt = now.Add(i.backoff)
+		slog.Warn("Writing to InfluxDB failed", "retry_in", i.backoff, "err", retryable.error)
+		return
+	}
+	if err != nil {
+		slog.Error("Writing to InfluxDB failed", "err", err)
+	}
+
+	i.pending = i.pending[:0]
+	i.backoff = 0
+}
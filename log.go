@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logLevel is the minimum level of log messages, for handlers other than
+// the default one.
+var logLevel slog.LevelVar
+
+// setupLogging configures the default slog logger from -log-format and
+// -log-level. The text format keeps going through the log package, so
+// plain log calls and slog records look alike.
+func setupLogging(format string, levelName string) error {
+	if err := setLogLevel(levelName); err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		// The default handler, whose level setLogLevel sets
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel})))
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	return nil
+}
+
+// setLogLevel changes the minimum level of log messages.
+func setLogLevel(levelName string) error {
+	level, ok := logLevels[levelName]
+	if !ok {
+		return fmt.Errorf("unknown log level: %s", levelName)
+	}
+
+	logLevel.Set(level)
+	slog.SetLogLoggerLevel(level)
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// discoveryConfig is a Home Assistant MQTT discovery payload for a sensor.
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	DeviceClass       string          `json:"device_class"`
+	UnitOfMeasurement string          `json:"unit_of_measurement"`
+	StateClass        string          `json:"state_class"`
+	Device            discoveryDevice `json:"device"`
+}
+
+type discoveryDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model"`
+}
+
+// mqttNodeID returns the node id of a meter used in discovery topics. Home
+// Assistant only allows alphanumerics, underscores and dashes there.
+func mqttNodeID(state *envState) string {
+	nodeID := *mqttNodeIDFlag
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, state.scoped(nodeID, "_"))
+}
+
+func mqttTopic(state *envState, name string) string {
+	return state.scoped(*mqttTopicPrefixFlag, "/") + "/" + name
+}
+
+// announce publishes the Home Assistant discovery config of a sensor.
+func announce(client mqtt.Client, state *envState, name string, deviceClass string, unit string) {
+	nodeID := mqttNodeID(state)
+
+	config, err := json.Marshal(discoveryConfig{
+		Name:              name,
+		UniqueID:          nodeID + "_" + deviceClass,
+		StateTopic:        mqttTopic(state, strings.ToLower(name)),
+		DeviceClass:       deviceClass,
+		UnitOfMeasurement: unit,
+		StateClass:        "measurement",
+		Device: discoveryDevice{
+			Identifiers: []string{"co2meter_" + nodeID},
+			Name:        "CO2 meter " + nodeID,
+			Model:       "USB-zyTemp",
+		},
+	})
+	if err != nil {
+		slog.Error("Encoding MQTT discovery config failed", "err", err)
+		return
+	}
+
+	publish(client, "homeassistant/sensor/"+nodeID+"/"+strings.ToLower(name)+"/config", config)
+}
+
+func newMQTTClient(unit temperatureUnit) mqtt.Client {
+	hostname, _ := os.Hostname()
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(*mqttBrokerFlag).
+		SetClientID("co2meter_exporter-" + hostname).
+		SetUsername(*mqttUsernameFlag).
+		SetPassword(*mqttPasswordFlag).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			slog.Info("Connected to MQTT broker", "broker", *mqttBrokerFlag)
+			if *mqttDiscoveryFlag {
+				for _, state := range states {
+					announce(client, state, "CO2", "carbon_dioxide", "ppm")
+					announce(client, state, "Temperature", "temperature", unit.unitOfMeasurement())
+				}
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Error("Lost connection to MQTT broker", "err", err)
+		})
+
+	return mqtt.NewClient(opts)
+}
+
+// mqttSink publishes the current readings as retained messages below the
+// topic prefix. With several meters, the readings of each are published
+// below a subtopic named after the meter.
+type mqttSink struct {
+	client            mqtt.Client
+	unit              temperatureUnit
+	humidityAnnounced map[*envState]bool
+	updated           updatedMeters
+}
+
+func newMQTTSink(unit temperatureUnit) *mqttSink {
+	m := &mqttSink{
+		client:            newMQTTClient(unit),
+		unit:              unit,
+		humidityAnnounced: make(map[*envState]bool),
+	}
+
+	// With connect retry enabled this only completes once connected,
+	// publishing is skipped until then.
+	m.client.Connect()
+
+	return m
+}
+
+func (m *mqttSink) Publish(event readingEvent) {
+	m.updated.add(event.state)
+}
+
+// Flush publishes the readings of the meters with readings since the last
+// flush, unless the broker is not connected.
+func (m *mqttSink) Flush(ctx context.Context) {
+	for _, state := range m.updated.take() {
+		if m.client.IsConnected() {
+			m.publish(state)
+		}
+	}
+}
+
+func (m *mqttSink) publish(state *envState) {
+
+	publish(m.client, mqttTopic(state, "co2"), fmt.Sprintf("%.0f", state.Co2()))
+	publish(m.client, mqttTopic(state, "temperature"), fmt.Sprintf("%.2f", m.unit.fromCelsius(state.Temperature())))
+	if state.hasHumidity.Load() {
+		// Meters without humidity sensor must not show up with one in
+		// Home Assistant, so announce it once it is known.
+		if *mqttDiscoveryFlag && !m.humidityAnnounced[state] {
+			announce(m.client, state, "Humidity", "humidity", "%")
+			m.humidityAnnounced[state] = true
+		}
+		publish(m.client, mqttTopic(state, "humidity"), fmt.Sprintf("%.2f", state.Humidity()))
+	}
+}
+
+func (m *mqttSink) Close() error {
+	m.client.Disconnect(250)
+	return nil
+}
+
+func publish(client mqtt.Client, topic string, payload any) {
+	token := client.Publish(topic, 0, true, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			slog.Error("MQTT publish failed", "err", token.Error())
+		}
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// notifier implements the sd_notify protocol of systemd. All methods do
+// nothing when not running under systemd with Type=notify.
+type notifier struct {
+	socket string
+	// interval between watchdog keep-alives, half of WATCHDOG_USEC, or 0
+	// if the watchdog is disabled.
+	interval     time.Duration
+	ready        sync.Once
+	lastWatchdog atomic.Int64
+}
+
+var systemd = newNotifier()
+
+func newNotifier() *notifier {
+	n := &notifier{socket: os.Getenv("NOTIFY_SOCKET")}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if err == nil && usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.interval = time.Duration(usec) * time.Microsecond / 2
+	}
+
+	return n
+}
+
+func (n *notifier) notify(state string) {
+	if n.socket == "" {
+		return
+	}
+
+	name := n.socket
+	if name[0] == '@' {
+		// Abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		slog.Error("Notifying systemd failed", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Error("Notifying systemd failed", "err", err)
+	}
+}
+
+// frameDecoded reports the service as ready on the first valid frame, and
+// keeps the watchdog happy as long as valid frames keep arriving.
+func (n *notifier) frameDecoded() {
+	if n.socket == "" {
+		return
+	}
+
+	n.ready.Do(func() {
+		n.notify("READY=1")
+	})
+
+	if n.interval > 0 {
+		now := time.Now().UnixNano()
+		last := n.lastWatchdog.Load()
+		if now-last >= int64(n.interval) && n.lastWatchdog.CompareAndSwap(last, now) {
+			n.notify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func dropPrivileges(userName string, groupName string) error {
+	return errors.New("dropping privileges is not supported on this platform")
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to the given user and group, either of which may
+// be empty. Files opened before stay open.
+func dropPrivileges(userName string, groupName string) error {
+	uid, gid := -1, -1
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return err
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+
+	// The group goes first, it can't be changed any more without root.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+		if syscall.Setuid(0) == nil {
+			return errors.New("regained root after dropping privileges")
+		}
+	}
+
+	return nil
+}
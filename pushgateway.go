@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pushSink pushes all metrics to the Pushgateway, for hosts that are too
+// often offline to be scraped. The metrics are deleted from the Pushgateway
+// on shutdown.
+type pushSink struct {
+	pusher *push.Pusher
+}
+
+func newPushSink(gatherer prometheus.Gatherer) *pushSink {
+	hostname, _ := os.Hostname()
+	return &pushSink{
+		pusher: push.New(*pushgatewayURLFlag, *pushJobFlag).
+			Gatherer(withoutTimestamps(gatherer)).
+			Grouping("instance", hostname),
+	}
+}
+
+// withoutTimestamps strips the timestamps of -reading-timestamps from the
+// samples of gatherer, as the Pushgateway rejects pushes with timestamps.
+func withoutTimestamps(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				metric.TimestampMs = nil
+			}
+		}
+		return families, err
+	})
+}
+
+// Publish does nothing, as the metrics are gathered from the registry.
+func (p *pushSink) Publish(event readingEvent) {}
+
+func (p *pushSink) Flush(ctx context.Context) {
+	if err := p.pusher.PushContext(ctx); err != nil && ctx.Err() == nil {
+		slog.Error("Pushing to Pushgateway failed", "err", err)
+	}
+}
+
+func (p *pushSink) Close() error {
+	if err := p.pusher.Delete(); err != nil {
+		return fmt.Errorf("deleting metrics from Pushgateway failed: %w", err)
+	}
+	return nil
+}
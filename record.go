@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const recordFlushInterval = time.Second * 5
+
+// recorder appends the raw frames of a meter to a file, which can be
+// replayed later.
+type recorder struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	maxSize int64
+	// maxFiles is the number of rotated files kept, 0 to truncate the
+	// file instead of rotating it.
+	maxFiles int
+}
+
+// recorders holds the recorders of all meters, for flushing and closing.
+var recorders []*recorder
+
+func newRecorder(path string, maxSize int64, maxFiles int) (*recorder, error) {
+	r := &recorder{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+	r.size = stat.Size()
+	return nil
+}
+
+// record appends a frame. Once the file would exceed the size limit, it is
+// rotated, or truncated and starts over without -record-max-files. The
+// recording stops if the file can't be reopened after rotating it.
+func (r *recorder) record(frame []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+	if r.maxSize > 0 && r.size+int64(len(frame)) > r.maxSize {
+		if r.maxFiles > 0 {
+			err := r.rotate()
+			switch {
+			case r.file == nil:
+				slog.Error("Reopening record file failed, recording stopped", "file", r.path, "err", err)
+			case err != nil:
+				slog.Error("Rotating record file failed", "file", r.path, "err", err)
+			}
+		} else {
+			r.writer.Reset(r.file)
+			if err := r.file.Truncate(0); err != nil {
+				slog.Error("Truncating record file failed", "file", r.path, "err", err)
+			}
+			r.size = 0
+		}
+	}
+	if r.file == nil {
+		return
+	}
+
+	r.writer.Write(frame)
+	r.size += int64(len(frame))
+}
+
+// rotatedName returns the name of the nth rotated file.
+func (r *recorder) rotatedName(n int) string {
+	return fmt.Sprintf("%s.%d.gz", r.path, n)
+}
+
+// rotate compresses the file to the first rotated file, after moving the
+// older ones up by one and dropping the oldest, and starts a new file. It
+// leaves r.file nil if the new file can't be opened.
+func (r *recorder) rotate() error {
+	r.writer.Flush()
+	r.file.Close()
+	r.file = nil
+
+	os.Remove(r.rotatedName(r.maxFiles))
+	var err error
+	for n := r.maxFiles - 1; n >= 1 && err == nil; n-- {
+		if err = os.Rename(r.rotatedName(n), r.rotatedName(n+1)); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = compressFile(r.path, r.rotatedName(1))
+	}
+	if err == nil {
+		err = os.Remove(r.path)
+	}
+	if err != nil {
+		// Start over rather than growing the file forever
+		os.Truncate(r.path, 0)
+	}
+
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// compressFile writes the file at path gzipped to dest.
+func compressFile(path string, dest string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+func (r *recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+	if err := r.writer.Flush(); err != nil {
+		slog.Error("Writing record file failed", "file", r.path, "err", err)
+		// Drop what can't be written instead of failing forever.
+		r.writer.Reset(r.file)
+	}
+}
+
+func (r *recorder) close() {
+	r.flush()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.file.Close()
+	}
+}
+
+// flushRecorders writes out buffered frames periodically, so a crash loses
+// little of the recording.
+func flushRecorders(ctx context.Context) {
+	for sleep(ctx, recordFlushInterval) {
+		for _, r := range recorders {
+			r.flush()
+		}
+	}
+}
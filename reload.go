@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+)
+
+// reloadOnHangup reloads the config file whenever the process gets
+// SIGHUP, until ctx is done.
+func reloadOnHangup(ctx context.Context, path string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			reloadConfig(path)
+		}
+	}
+}
+
+// reloadConfig re-reads the config file. Changes of the reloadable flags
+// take effect, as long as they are valid, while others are logged as
+// needing a restart. Keys removed from the file reset their flag to the
+// default. The flags are not touched before the changes are known, as other
+// goroutines keep reading those that are not reloadable.
+func reloadConfig(path string) {
+	values := map[string]flag.Value{}
+	err := loadConfig(path, func(name, value string) error {
+		if values[name] == nil {
+			values[name] = newFlagValue(flag.Lookup(name))
+		}
+		return values[name].Set(value)
+	})
+	if err != nil {
+		slog.Error("Reloading config failed", "err", err)
+		return
+	}
+
+	changed := map[string]string{}
+	previous := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if pinnedFlags[f.Name] {
+			return
+		}
+		value := f.DefValue
+		if values[f.Name] != nil {
+			value = values[f.Name].String()
+		}
+		if value == f.Value.String() {
+			return
+		}
+		if !reloadableFlags[f.Name] {
+			slog.Warn("Changed setting needs a restart", "setting", f.Name)
+			return
+		}
+		changed[f.Name] = value
+		previous[f.Name] = f.Value.String()
+	})
+	if len(changed) == 0 {
+		slog.Info("Reloaded config, no settings changed")
+		return
+	}
+
+	for name, value := range changed {
+		flag.Set(name, value)
+	}
+	s, err := newSettings()
+	if err == nil {
+		err = setLogLevel(*logLevelFlag)
+	}
+	if err != nil {
+		slog.Error("Reloading config failed", "err", err)
+		for name, value := range previous {
+			flag.Set(name, value)
+		}
+		return
+	}
+	liveSettings.Store(s)
+
+	for _, name := range slices.Sorted(maps.Keys(changed)) {
+		slog.Info("Updated setting", "setting", name, "value", changed[name])
+	}
+}
+
+// newFlagValue returns a new zero value of the type of the value of f, to
+// parse values into without changing the flag.
+func newFlagValue(f *flag.Flag) flag.Value {
+	return reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+}
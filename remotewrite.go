@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteBatchSize  = 500
+	remoteWriteMaxPending = 10000
+	remoteWriteMaxBackoff = time.Minute * 5
+)
+
+type remoteLabel struct {
+	name  string
+	value string
+}
+
+// remoteSeries is a single sample of a time series, with the labels sorted
+// by name as remote write wants them.
+type remoteSeries struct {
+	labels    []remoteLabel
+	value     float64
+	timestamp int64 // milliseconds
+}
+
+// remoteSeriesOf flattens the gathered metric families into samples, taken
+// at now unless a metric has a timestamp of its own.
+func remoteSeriesOf(families []*dto.MetricFamily, base []remoteLabel, now time.Time) []remoteSeries {
+	var series []remoteSeries
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			timestamp := now.UnixMilli()
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+			labels := slices.Clone(base)
+			for _, pair := range m.GetLabel() {
+				// Empty labels are the same as missing ones
+				if pair.GetValue() != "" {
+					labels = append(labels, remoteLabel{pair.GetName(), pair.GetValue()})
+				}
+			}
+			add := func(suffix string, value float64, extra ...remoteLabel) {
+				all := append(append(slices.Clone(labels), remoteLabel{"__name__", family.GetName() + suffix}), extra...)
+				slices.SortFunc(all, func(a, b remoteLabel) int { return strings.Compare(a.name, b.name) })
+				series = append(series, remoteSeries{all, value, timestamp})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), remoteLabel{"le", formatFloat(b.GetUpperBound())})
+				}
+				add("_bucket", float64(h.GetSampleCount()), remoteLabel{"le", "+Inf"})
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), remoteLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series as remote write WriteRequest protobuf
+// message, one TimeSeries per sample.
+func encodeWriteRequest(series []remoteSeries) []byte {
+	var request []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+	return request
+}
+
+func writeRemote(ctx context.Context, series []remoteSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *remoteWriteURLFlag, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if *remoteWriteTokenFlag != "" {
+		req.Header.Set("Authorization", "Bearer "+*remoteWriteTokenFlag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errRetryable{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("remote write failed: %s: %s", resp.Status, bytes.TrimSpace(message))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return errRetryable{err}
+	}
+	return err
+}
+
+// remoteWriteSink sends all metrics to a Prometheus remote write endpoint,
+// in batches of at most remoteWriteBatchSize samples. Samples that could not
+// be sent are kept and sent together with the next ones, backing off
+// exponentially while the server fails.
+type remoteWriteSink struct {
+	gatherer    prometheus.Gatherer
+	labels      []remoteLabel
+	interval    time.Duration
+	pending     []remoteSeries
+	backoff     time.Duration
+	nextAttempt time.Time
+}
+
+func newRemoteWriteSink(gatherer prometheus.Gatherer, interval time.Duration) *remoteWriteSink {
+	hostname, _ := os.Hostname()
+	return &remoteWriteSink{
+		gatherer: gatherer,
+		labels:   []remoteLabel{{"instance", hostname}, {"job", *remoteWriteJobFlag}},
+		interval: interval,
+	}
+}
+
+// Publish does nothing, as the metrics are gathered from the registry.
+func (r *remoteWriteSink) Publish(event readingEvent) {}
+
+func (r *remoteWriteSink) Flush(ctx context.Context) {
+	now := time.Now()
+	families, err := r.gatherer.Gather()
+	if err != nil {
+		slog.Error("Gathering metrics for remote write failed", "err", err)
+	}
+	r.pending = append(r.pending, remoteSeriesOf(families, r.labels, now)...)
+	if len(r.pending) > remoteWriteMaxPending {
+		r.pending = r.pending[len(r.pending)-remoteWriteMaxPending:]
+	}
+
+	if now.Before(r.nextAttempt) {
+		return
+	}
+
+	for len(r.pending) > 0 {
+		batch := r.pending[:min(len(r.pending), remoteWriteBatchSize)]
+		err := writeRemote(ctx, batch)
+		if retryable, ok := err.(errRetryable); ok {
+			r.backoff = min(max(r.backoff*2, r.interval), remoteWriteMaxBackoff)
+			r.nextAttempt = now.Add(r.backoff)
+			slog.Warn("Remote write failed", "retry_in", r.backoff, "err", retryable.error)
+			return
+		}
+		if err != nil {
+			slog.Error("Remote write failed", "err", err)
+		}
+		r.pending = r.pending[len(batch):]
+	}
+	r.backoff = 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// settings are those that can be changed at runtime by reloading the config
+// file, see reloadConfig. Everything else reads its flag directly.
+type settings struct {
+	// The offsets are folded into the intercepts, and the pressure
+	// correction into the CO2 slope.
+	co2Calibration         calibration
+	temperatureCalibration calibration
+	ambientPressure        float64 // Pa
+
+	staleness        time.Duration
+	stuckThreshold   time.Duration
+	reportInterval   time.Duration
+	alertThreshold   int
+	alertHysteresis  int
+	alertMinInterval time.Duration
+}
+
+// reloadableFlags are the flags read by newSettings, and -log-level.
+var reloadableFlags = map[string]bool{
+	"co2-offset":         true,
+	"co2-slope":          true,
+	"co2-intercept":      true,
+	"temp-offset":        true,
+	"temp-slope":         true,
+	"temp-intercept":     true,
+	"pressure":           true,
+	"altitude":           true,
+	"staleness":          true,
+	"stuck-threshold":    true,
+	"report-interval":    true,
+	"alert-threshold":    true,
+	"alert-hysteresis":   true,
+	"alert-min-interval": true,
+	"log-level":          true,
+}
+
+var liveSettings atomic.Pointer[settings]
+
+// current returns the settings in effect.
+func current() *settings {
+	return liveSettings.Load()
+}
+
+// newSettings validates the flags of the settings and builds them.
+func newSettings() (*settings, error) {
+	if *reportIntervalFlag <= 0 {
+		return nil, errors.New("report interval must be positive")
+	}
+	if *stuckThresholdFlag < 0 {
+		return nil, errors.New("stuck threshold must not be negative")
+	}
+	if *pressureFlag != 0 && *altitudeFlag != 0 {
+		return nil, errors.New("-pressure and -altitude are mutually exclusive")
+	}
+	if *pressureFlag < 0 {
+		return nil, errors.New("pressure must be positive")
+	}
+	if *altitudeFlag > 10000 {
+		return nil, errors.New("altitude must be below 10000 meters")
+	}
+	if *alertHysteresisFlag < 0 {
+		return nil, errors.New("alert hysteresis must not be negative")
+	}
+
+	s := &settings{
+		co2Calibration:         calibration{*co2SlopeFlag, *co2InterceptFlag + float64(*co2OffsetFlag)},
+		temperatureCalibration: calibration{*tempSlopeFlag, *tempInterceptFlag + *tempOffsetFlag},
+		ambientPressure:        standardPressure,
+		staleness:              *stalenessFlag,
+		stuckThreshold:         *stuckThresholdFlag,
+		reportInterval:         *reportIntervalFlag,
+		alertThreshold:         *alertThresholdFlag,
+		alertHysteresis:        *alertHysteresisFlag,
+		alertMinInterval:       *alertMinIntervalFlag,
+	}
+	switch {
+	case *pressureFlag != 0:
+		s.ambientPressure = *pressureFlag * 100
+	case *altitudeFlag != 0:
+		s.ambientPressure = altitudePressure(*altitudeFlag)
+	}
+	// The pressure correction applies to the raw readings, the calibration
+	// against a reference instrument to corrected ones.
+	s.co2Calibration.slope *= pressureCorrection(s.ambientPressure)
+
+	return s, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// sinkBufferSize is the number of readings buffered for every sink.
+const sinkBufferSize = 64
+
+// sink is an output of the readings, like /metrics, MQTT or InfluxDB.
+type sink interface {
+	// Publish hands a reading to the sink, once applyReadings updated the
+	// state of its meter with it.
+	Publish(event readingEvent)
+
+	// Flush sends out what was published since the last flush, every
+	// report interval.
+	Flush(ctx context.Context)
+}
+
+// namedSink is a sink subscribed to the applied readings.
+type namedSink struct {
+	name        string
+	sink        sink
+	events      <-chan readingEvent
+	unsubscribe func()
+}
+
+// subscribeSink subscribes a sink to the applied readings. Sinks are
+// subscribed before the readers start, so they get all readings.
+func subscribeSink(name string, s sink) namedSink {
+	events, unsubscribe := applied.subscribe(name, sinkBufferSize)
+	return namedSink{name, s, events, unsubscribe}
+}
+
+// runSinks feeds the applied readings to the sinks, and flushes them every
+// report interval. Each sink runs in a goroutine of their own and skips a
+// flush while still busy with the previous one, so a slow server does not
+// hold up the others. Sinks implementing io.Closer are closed once ctx is
+// done.
+func runSinks(ctx context.Context, sinks []namedSink) {
+	var wg sync.WaitGroup
+	ticks := make([]chan struct{}, len(sinks))
+	for i, s := range sinks {
+		ticks[i] = make(chan struct{}, 1)
+		wg.Go(func() {
+			defer s.unsubscribe()
+			supervise(ctx, s.name, func() { feedSink(ctx, s.sink, s.events, ticks[i]) })
+			if closer, ok := s.sink.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					slog.Error("Closing output failed", "output", s.name, "err", err)
+				}
+			}
+		})
+	}
+
+	for sleep(ctx, current().reportInterval) {
+		for _, tick := range ticks {
+			select {
+			case tick <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	wg.Wait()
+}
+
+func feedSink(ctx context.Context, s sink, events <-chan readingEvent, ticks <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			s.Publish(event)
+		case <-ticks:
+			s.Flush(ctx)
+		}
+	}
+}
+
+// updatedMeters collects the meters with readings since the last flush, in
+// the order they came in, for the sinks reporting the state of a meter
+// rather than single readings.
+type updatedMeters struct {
+	seen   map[*envState]bool
+	states []*envState
+}
+
+func (u *updatedMeters) add(state *envState) {
+	if u.seen == nil {
+		u.seen = make(map[*envState]bool)
+	}
+	if !u.seen[state] {
+		u.seen[state] = true
+		u.states = append(u.states, state)
+	}
+}
+
+// take returns the meters collected since the last call.
+func (u *updatedMeters) take() []*envState {
+	states := u.states
+	u.states = nil
+	clear(u.seen)
+	return states
+}
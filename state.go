@@ -0,0 +1,450 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rnurgaliyev/co2meter_exporter/co2meter"
+)
+
+// envState holds the latest readings of a meter. It is written by the
+// reader goroutine of the meter and read concurrently by all outputs.
+type envState struct {
+	device   string
+	location string
+	info     co2meter.Info
+	model    co2meter.Model // zero if unknown
+
+	co2            atomic.Int32
+	rawCo2         atomic.Int32
+	rawTemperature atomic.Int32
+	temperature    atomic.Uint64 // calibrated, math.Float64bits of degree celsius
+	rawHumidity    atomic.Int32
+	hasCo2         atomic.Bool
+	hasTemperature atomic.Bool
+	hasHumidity    atomic.Bool
+	lastReading    atomic.Int64
+	connected      atomic.Bool // whether the device is open
+	// co2Since is when the accepted raw CO2 reading last changed to
+	// stuckCo2, for detecting a stuck sensor. Unlike rawCo2, stuckCo2 is
+	// not set by outliers, which must not hide a stuck sensor.
+	co2Since atomic.Int64
+	stuckCo2 atomic.Int32
+	stuck    atomic.Bool
+	// connectedAt is when the device was last opened, and ready whether
+	// the sensor warmed up since.
+	connectedAt atomic.Int64
+	ready       atomic.Bool
+
+	// mu guards the derived readings, starting with the CO2 smoothing
+	// state: a ring buffer of the latest raw readings, which is nil if
+	// window smoothing is disabled, and the exponentially weighted moving
+	// average.
+	mu          sync.Mutex
+	co2Window   []int32
+	co2WindowAt int
+	co2WindowN  int
+	ewma        float64
+	hasEwma     bool
+
+	// medianWindow holds the latest raw CO2 readings to reject outliers
+	// against, nil if -median-window is not given. Guarded by mu as well.
+	medianWindow []int32
+	medianAt     int
+	medianN      int
+
+	// co2Range and temperatureRange track the readings within -window to
+	// report their minimum and maximum. They are guarded by mu as well.
+	co2Range         rollingWindow
+	temperatureRange rollingWindow
+
+	// co2Rate and temperatureRate track the change between readings, also
+	// guarded by mu.
+	co2Rate         rateTracker
+	temperatureRate rateTracker
+
+	invalidReadings prometheus.Counter
+	reconnects      prometheus.Counter
+	readTimeouts    prometheus.Counter
+	outliers        prometheus.Counter
+	// co2Histogram is nil unless -co2-buckets is given
+	co2Histogram prometheus.Observer
+
+	// recorder saves the raw frames with -record, nil otherwise.
+	recorder *recorder
+}
+
+// states holds one envState per meter, in the order the devices were given.
+var states []*envState
+
+var stateLabels = []string{"device", "location", "serial"}
+
+func newEnvState(device string, location string, info co2meter.Info) *envState {
+	s := &envState{
+		device:   device,
+		location: location,
+		info:     info,
+	}
+	if *smoothWindowFlag > 0 {
+		s.co2Window = make([]int32, *smoothWindowFlag)
+	}
+	if *medianWindowFlag > 0 {
+		s.medianWindow = make([]int32, *medianWindowFlag)
+	}
+	s.invalidReadings = invalidReadingsCounter.WithLabelValues(s.labelValues()...)
+	s.reconnects = reconnectsCounter.WithLabelValues(s.labelValues()...)
+	s.readTimeouts = readTimeoutsCounter.WithLabelValues(s.labelValues()...)
+	s.outliers = outliersCounter.WithLabelValues(s.labelValues()...)
+	if co2Histogram != nil {
+		s.co2Histogram = co2Histogram.WithLabelValues(s.labelValues()...)
+	}
+
+	return s
+}
+
+func (s *envState) labelValues() []string {
+	return []string{s.device, s.location, s.serial()}
+}
+
+// readError counts a failed read or invalid frame.
+func (s *envState) readError(reason string) {
+	readErrorsCounter.WithLabelValues(append(s.labelValues(), reason)...).Inc()
+}
+
+// serial returns the serial number of the meter, falling back to the device
+// path for meters that have none.
+func (s *envState) serial() string {
+	if s.info.Serial != "" {
+		return s.info.Serial
+	}
+	return s.device
+}
+
+// name identifies the meter towards outputs that have no labels.
+func (s *envState) name() string {
+	if s.location != "" {
+		return s.location
+	}
+	return filepath.Base(s.device)
+}
+
+// scoped appends the name of the meter to prefix if there are several, so
+// a single meter keeps the plain prefix.
+func (s *envState) scoped(prefix string, sep string) string {
+	if len(states) == 1 {
+		return prefix
+	}
+	return prefix + sep + s.name()
+}
+
+func (s *envState) Co2() float64 {
+	return float64(s.co2.Load())
+}
+
+// RawCo2 returns the CO2 reading as the meter reported it, before
+// calibration.
+func (s *envState) RawCo2() float64 {
+	return float64(s.rawCo2.Load())
+}
+
+func (s *envState) Temperature() float64 {
+	return math.Round(math.Float64frombits(s.temperature.Load())*100) / 100
+}
+
+// RawTemperature returns the temperature as the meter reported it, before
+// calibration.
+func (s *envState) RawTemperature() float64 {
+	return math.Round(kelvin16ToCelsius(s.rawTemperature.Load())*100) / 100
+}
+
+func (s *envState) Humidity() float64 {
+	return float64(s.rawHumidity.Load()) / 100
+}
+
+func (s *envState) LastReading() time.Time {
+	nsec := s.lastReading.Load()
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+func (s *envState) IsUp() bool {
+	return time.Since(s.LastReading()) < current().staleness
+}
+
+func (s *envState) Up() float64 {
+	if s.IsUp() {
+		return 1
+	}
+	return 0
+}
+
+// resetSmoothing empties the smoothing window, so readings from before a
+// reconnect don't mix with the new ones.
+func (s *envState) resetSmoothing() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.co2WindowAt = 0
+	s.co2WindowN = 0
+	s.medianAt = 0
+	s.medianN = 0
+	s.hasEwma = false
+	s.co2Rate = rateTracker{}
+	s.temperatureRate = rateTracker{}
+}
+
+// Stuck reports whether the sensor repeated the same CO2 reading for longer
+// than -stuck-threshold.
+func (s *envState) Stuck() float64 {
+	if s.stuck.Load() {
+		return 1
+	}
+	return 0
+}
+
+// setConnected records that the device was opened, which starts the warmup
+// of the sensor.
+func (s *envState) setConnected() {
+	s.connectedAt.Store(time.Now().UnixNano())
+	s.ready.Store(false)
+	if !s.connected.Swap(true) {
+		stateChangesCounter.WithLabelValues(append(s.labelValues(), "connected")...).Inc()
+	}
+}
+
+// setDisconnected records that the device was closed.
+func (s *envState) setDisconnected() {
+	if s.connected.Swap(false) {
+		stateChangesCounter.WithLabelValues(append(s.labelValues(), "disconnected")...).Inc()
+	}
+}
+
+// IsReady reports whether the sensor delivered a reading after its warmup.
+func (s *envState) IsReady() bool {
+	return s.ready.Load()
+}
+
+func (s *envState) Ready() float64 {
+	if s.IsReady() {
+		return 1
+	}
+	return 0
+}
+
+// checkWarmup marks the sensor as ready once the warmup elapsed.
+func (s *envState) checkWarmup(now time.Time) {
+	if s.ready.Load() || now.Sub(time.Unix(0, s.connectedAt.Load())) < *warmupFlag {
+		return
+	}
+	if !s.ready.Swap(true) && *warmupFlag > 0 {
+		slog.Info("Sensor warmed up", "device", s.device)
+	}
+}
+
+// checkStuck tracks for how long the accepted raw CO2 reading stayed the
+// same.
+func (s *envState) checkStuck(raw int32, now time.Time) {
+	if previous := s.stuckCo2.Swap(raw); !s.hasCo2.Load() || previous != raw {
+		s.co2Since.Store(now.UnixNano())
+		if s.stuck.Swap(false) {
+			slog.Info("Sensor recovered", "device", s.device, "co2", raw)
+		}
+		return
+	}
+
+	if threshold := current().stuckThreshold; threshold > 0 && now.Sub(time.Unix(0, s.co2Since.Load())) > threshold && !s.stuck.Swap(true) {
+		slog.Warn("Sensor seems stuck", "device", s.device, "co2", raw, "since", time.Unix(0, s.co2Since.Load()))
+	}
+}
+
+func (s *envState) setCo2(raw int32, value int32) {
+	s.checkStuck(raw, time.Now())
+	s.rawCo2.Store(raw)
+
+	s.mu.Lock()
+	s.co2Range.add(time.Now(), float64(value))
+	s.co2Rate.add(time.Now(), float64(value))
+	if s.co2Window != nil {
+		s.co2Window[s.co2WindowAt] = value
+		s.co2WindowAt = (s.co2WindowAt + 1) % len(s.co2Window)
+		s.co2WindowN = min(s.co2WindowN+1, len(s.co2Window))
+	}
+	if alpha := *ewmaAlphaFlag; alpha > 0 {
+		if s.hasEwma {
+			s.ewma = alpha*float64(value) + (1-alpha)*s.ewma
+		} else {
+			s.ewma = float64(value)
+			s.hasEwma = true
+		}
+	}
+	s.mu.Unlock()
+
+	if s.co2Histogram != nil {
+		s.co2Histogram.Observe(float64(value))
+	}
+
+	s.co2.Store(value)
+	s.hasCo2.Store(true)
+	s.lastReading.Store(time.Now().UnixNano())
+}
+
+// acceptCo2 reports whether a raw CO2 reading is within -outlier-threshold
+// of the median of the last -median-window readings, which include it. An
+// outlier is only stored as raw reading, and counted. Readings are taken as
+// they are until the window is full.
+func (s *envState) acceptCo2(raw int32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.medianWindow == nil {
+		return true
+	}
+	s.medianWindow[s.medianAt] = raw
+	s.medianAt = (s.medianAt + 1) % len(s.medianWindow)
+	s.medianN = min(s.medianN+1, len(s.medianWindow))
+	if s.medianN < len(s.medianWindow) {
+		return true
+	}
+
+	sorted := slices.Sorted(slices.Values(s.medianWindow))
+	median := sorted[len(sorted)/2]
+	threshold := int32(*outlierThresholdFlag)
+	if raw-median >= -threshold && raw-median <= threshold {
+		return true
+	}
+
+	s.rawCo2.Store(raw)
+	s.outliers.Inc()
+	return false
+}
+
+// derivedReadings are the readings derived from the latest ones: the
+// smoothed CO2 readings, and the rates and ranges within -window.
+type derivedReadings struct {
+	smoothedCo2 float64 // mean of the smoothing window, zero if empty
+	ewmaCo2     float64
+
+	co2Rate, temperatureRate       float64 // per minute
+	hasCo2Rate, hasTemperatureRate bool
+
+	co2Min, co2Max                   float64
+	temperatureMin, temperatureMax   float64 // degree celsius
+	hasCo2Range, hasTemperatureRange bool
+}
+
+// derived returns the derived readings, consistent with each other as they
+// are taken under a single lock.
+func (s *envState) derived() derivedReadings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	d := derivedReadings{
+		ewmaCo2:            s.ewma,
+		co2Rate:            s.co2Rate.rate,
+		hasCo2Rate:         s.co2Rate.hasRate,
+		temperatureRate:    s.temperatureRate.rate,
+		hasTemperatureRate: s.temperatureRate.hasRate,
+	}
+	d.co2Min, d.co2Max, d.hasCo2Range = s.co2Range.minMax(now)
+	d.temperatureMin, d.temperatureMax, d.hasTemperatureRange = s.temperatureRange.minMax(now)
+
+	if s.co2WindowN > 0 {
+		var sum int64
+		for _, value := range s.co2Window[:s.co2WindowN] {
+			sum += int64(value)
+		}
+		d.smoothedCo2 = float64(sum) / float64(s.co2WindowN)
+	}
+
+	return d
+}
+
+func (s *envState) setTemperature(raw int32, celsius float64) {
+	s.rawTemperature.Store(raw)
+	s.temperature.Store(math.Float64bits(celsius))
+	s.mu.Lock()
+	s.temperatureRange.add(time.Now(), s.Temperature())
+	s.temperatureRate.add(time.Now(), celsius)
+	s.mu.Unlock()
+	s.hasTemperature.Store(true)
+	s.lastReading.Store(time.Now().UnixNano())
+}
+
+func (s *envState) setHumidity(raw int32) {
+	s.rawHumidity.Store(raw)
+	s.hasHumidity.Store(true)
+	s.lastReading.Store(time.Now().UnixNano())
+}
+
+type windowReading struct {
+	at    time.Time
+	value float64
+}
+
+// rollingWindow keeps the readings of the last -window, oldest first.
+type rollingWindow struct {
+	readings []windowReading
+}
+
+func (w *rollingWindow) add(now time.Time, value float64) {
+	if *windowFlag <= 0 {
+		return
+	}
+	w.readings = append(w.readings, windowReading{now, value})
+	w.prune(now)
+}
+
+// prune drops the readings that fell out of the window.
+func (w *rollingWindow) prune(now time.Time) {
+	i := 0
+	for i < len(w.readings) && now.Sub(w.readings[i].at) > *windowFlag {
+		i++
+	}
+	if i > 0 {
+		w.readings = append(w.readings[:0], w.readings[i:]...)
+	}
+}
+
+func (w *rollingWindow) minMax(now time.Time) (min, max float64, ok bool) {
+	w.prune(now)
+	if len(w.readings) == 0 {
+		return 0, 0, false
+	}
+
+	min, max = w.readings[0].value, w.readings[0].value
+	for _, r := range w.readings[1:] {
+		min = math.Min(min, r.value)
+		max = math.Max(max, r.value)
+	}
+	return min, max, true
+}
+
+// rateTracker computes the change per minute between consecutive readings,
+// smoothed with -ewma-alpha if given.
+type rateTracker struct {
+	last    float64
+	at      time.Time
+	rate    float64
+	hasRate bool
+}
+
+func (t *rateTracker) add(now time.Time, value float64) {
+	if elapsed := now.Sub(t.at); !t.at.IsZero() && elapsed > 0 {
+		rate := (value - t.last) / elapsed.Minutes()
+		if alpha := *ewmaAlphaFlag; alpha > 0 && t.hasRate {
+			rate = alpha*rate + (1-alpha)*t.rate
+		}
+		t.rate, t.hasRate = rate, true
+	}
+
+	t.last, t.at = value, now
+}
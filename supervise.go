@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	panicRestartDelay     = time.Second * 5
+	readerMaxRestartDelay = time.Minute * 5
+)
+
+// Created by newCounters, as their names depend on flags
+var (
+	goroutinePanicsCounter *prometheus.CounterVec
+	readerRestartsCounter  *prometheus.CounterVec
+)
+
+// supervise runs fn and restarts it after a delay if it panics, until fn
+// returns normally or ctx is cancelled.
+func supervise(ctx context.Context, name string, fn func()) {
+	for !runRecovered(name, fn) {
+		goroutinePanicsCounter.WithLabelValues(name).Inc()
+		if !sleep(ctx, panicRestartDelay) {
+			return
+		}
+		slog.Info("Restarting after panic", "goroutine", name)
+	}
+}
+
+// superviseReader runs the reader of the meter of state like supervise, but
+// backs off exponentially while it keeps failing, so a broken meter does not
+// spin while the others keep reading. The restarts are counted per meter,
+// along with the reopens of getReadings after fatal read errors, which back
+// off in reconnect.
+func superviseReader(ctx context.Context, state *envState, fn func()) {
+	delay := panicRestartDelay
+	for {
+		started := time.Now()
+		if runRecovered("reader", fn) {
+			return
+		}
+		goroutinePanicsCounter.WithLabelValues("reader").Inc()
+		readerRestartsCounter.WithLabelValues(state.labelValues()...).Inc()
+
+		// A reader that ran fine for a while starts over with the short
+		// delay
+		if time.Since(started) > readerMaxRestartDelay {
+			delay = panicRestartDelay
+		}
+		if !sleep(ctx, delay) {
+			return
+		}
+		slog.Info("Restarting reader after panic", "device", state.device, "delay", delay)
+		delay = min(delay*2, readerMaxRestartDelay)
+	}
+}
+
+// runRecovered runs fn and reports whether it returned without panicking.
+func runRecovered(name string, fn func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Goroutine panicked", "goroutine", name, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			ok = false
+		}
+	}()
+
+	fn()
+	return true
+}
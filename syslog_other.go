@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func setupSyslog(address string) error {
+	return errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,92 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// syslogHandler sends log records to syslog at the priority of their
+// level, with the attributes formatted as by the text handler.
+type syslogHandler struct {
+	writer *syslog.Writer
+	text   slog.Handler
+	mu     *sync.Mutex
+	buf    *bytes.Buffer
+}
+
+// setupSyslog makes the default logger log to the syslog daemon at
+// address, which is given as udp://host:port or tcp://host:port, or to the
+// local one if empty.
+func setupSyslog(address string) error {
+	var network, raddr string
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid syslog address: %s", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "co2meter_exporter")
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	text := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: &logLevel,
+		// syslog has time and priority of its own, and the message
+		// goes first.
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	slog.SetDefault(slog.New(&syslogHandler{writer, text, new(sync.Mutex), buf}))
+
+	return nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buf.Reset()
+	if err := h.text.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSpace(r.Message + " " + strings.TrimSpace(h.buf.String()))
+
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.writer.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.writer.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.writer.Info(msg)
+	default:
+		return h.writer.Debug(msg)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{h.writer, h.text.WithAttrs(attrs), h.mu, h.buf}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{h.writer, h.text.WithGroup(name), h.mu, h.buf}
+}